@@ -0,0 +1,265 @@
+// Package auth authenticates control requests between the visualizer, the
+// worm gates and the segments with a shared secret.
+//
+// The visualizer generates the secret and saves it to a file. The worm gates
+// and `segment spread` read it from that file, and the worm gates hand it to
+// the segments they start through the WORM_SECRET environment variable.
+//
+// Every request carries a timestamp, a random nonce, and an HMAC-SHA256 of
+// the method, the host it was sent to, the request URI, the timestamp, the
+// nonce and the SHA-256 of the body. Requests with a bad signature, a
+// timestamp too far off, or a nonce seen before are answered with 401. Since
+// the host is signed, a request captured on its way to one node can't be
+// replayed to another.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request headers
+const (
+	HeaderTimestamp = "X-Worm-Timestamp"
+	HeaderNonce     = "X-Worm-Nonce"
+	HeaderSignature = "X-Worm-Signature"
+)
+
+// EnvVar is the environment variable that passes the secret to segments.
+const EnvVar = "WORM_SECRET"
+
+// MaxBodySize is the largest body a signed request may have. Control
+// requests are small, and the body of a request that is not authenticated
+// yet has to be read to check it.
+const MaxBodySize = 1 << 20
+
+// Bodies we can't read ahead of sending (streams) are signed as this marker
+// instead of their hash. They never pass verification.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// LoadSecret reads a hex encoded secret from a file.
+func LoadSecret(fn string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// CreateSecret loads the secret in fn, generating a new one if the file does
+// not exist yet.
+func CreateSecret(fn string) ([]byte, error) {
+	secret, err := LoadSecret(fn)
+	if !os.IsNotExist(err) {
+		return secret, err
+	}
+
+	secret = make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(fn, []byte(hex.EncodeToString(secret)+"\n"), 0600)
+	return secret, err
+}
+
+// SecretFromEnv returns the secret passed in the environment, if any.
+func SecretFromEnv() ([]byte, error) {
+	s := os.Getenv(EnvVar)
+	if s == "" {
+		return nil, nil
+	}
+	return hex.DecodeString(s)
+}
+
+// Env returns the environment variable setting that passes secret on to a
+// child process.
+func Env(secret []byte) string {
+	return EnvVar + "=" + hex.EncodeToString(secret)
+}
+
+func signature(secret []byte, method, host, uri, timestamp, nonce, bodyHash string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n%s", method, strings.ToLower(host), uri, timestamp, nonce, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign adds the authentication headers to a request. The body is read
+// through req.GetBody, so the request can still be sent afterwards.
+func Sign(req *http.Request, secret []byte) error {
+	bodyHash := hashBody(nil)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+		bodyHash = hashBody(data)
+	} else if req.Body != nil && req.Body != http.NoBody {
+		bodyHash = unsignedPayload
+	}
+
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+	// What the server will see in the Host header
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonceHex)
+	req.Header.Set(HeaderSignature,
+		signature(secret, req.Method, host, req.URL.RequestURI(), timestamp, nonceHex, bodyHash))
+	return nil
+}
+
+// Transport signs every request it sends. With an empty secret it sends
+// requests as they are.
+type Transport struct {
+	Secret []byte
+	Base   http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.Secret) == 0 {
+		return t.Base.RoundTrip(req)
+	}
+	// RoundTrippers must not modify the request
+	signed := req.Clone(req.Context())
+	if err := Sign(signed, t.Secret); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.Base.RoundTrip(signed)
+}
+
+// Verifier checks the authentication headers of incoming requests.
+type Verifier struct {
+	secret  []byte
+	maxSkew time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewVerifier creates a verifier that accepts timestamps up to maxSkew off
+// from our clock. With an empty secret it accepts everything, and says so.
+func NewVerifier(secret []byte, maxSkew time.Duration) *Verifier {
+	if len(secret) == 0 {
+		log.Print("WARNING: no secret given, control requests are not authenticated. " +
+			"Anyone who can reach this process can command it. Use -secretfile.")
+	}
+	return &Verifier{
+		secret:  secret,
+		maxSkew: maxSkew,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// Verify checks a request. It reads the body and replaces it with a copy, so
+// handlers can still read it.
+func (v *Verifier) Verify(r *http.Request) error {
+	if len(v.secret) == 0 {
+		return nil
+	}
+
+	timestamp := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	given := r.Header.Get(HeaderSignature)
+	if timestamp == "" || nonce == "" || given == "" {
+		return fmt.Errorf("missing authentication headers")
+	}
+	if len(nonce) != 24 || len(given) != 2*sha256.Size {
+		return fmt.Errorf("malformed authentication headers")
+	}
+	v.mu.Lock()
+	_, replayed := v.seen[nonce]
+	v.mu.Unlock()
+	if replayed {
+		return fmt.Errorf("replayed nonce")
+	}
+
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp %q", timestamp)
+	}
+	now := time.Now()
+	skew := now.Sub(time.Unix(secs, 0))
+	if skew > v.maxSkew || skew < -v.maxSkew {
+		return fmt.Errorf("timestamp off by %s", skew)
+	}
+
+	// Everything else checks out, now the body is worth reading
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBodySize+1))
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) > MaxBodySize {
+		return fmt.Errorf("body larger than %d bytes", MaxBodySize)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	expected := signature(v.secret, r.Method, r.Host, r.URL.RequestURI(), timestamp, nonce, hashBody(body))
+	if !hmac.Equal([]byte(expected), []byte(given)) {
+		return fmt.Errorf("bad signature")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for n, t := range v.seen {
+		if now.Sub(t) > 2*v.maxSkew {
+			delete(v.seen, n)
+		}
+	}
+	if _, replayed := v.seen[nonce]; replayed {
+		return fmt.Errorf("replayed nonce")
+	}
+	v.seen[nonce] = now
+	return nil
+}
+
+// Require wraps a handler so that it only sees authenticated requests.
+func (v *Verifier) Require(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(v.secret) > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, MaxBodySize)
+		}
+		if err := v.Verify(r); err != nil {
+			log.Printf("Unauthorized %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+			io.Copy(ioutil.Discard, r.Body)
+			r.Body.Close()
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
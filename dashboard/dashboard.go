@@ -0,0 +1,199 @@
+// Package dashboard serves a web page that shows what the visualizer shows,
+// and takes the same commands.
+//
+// The page gets a Snapshot of the visualizer's state from /events as a
+// stream of server-sent events, and posts commands to /command.
+//
+// Commands must carry the token the page was served with, and come from the
+// page itself: a page on another site can't read the token, and cross-origin
+// requests are refused outright.
+package dashboard
+
+import (
+	"../report"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TokenHeader is the request header that carries the token on commands.
+const TokenHeader = "X-Dashboard-Token"
+
+//go:embed static
+var static embed.FS
+
+// Node is the status of one node.
+type Node struct {
+	Name      string  `json:"name"`
+	Wormgate  bool    `json:"wormgate"`
+	Segment   bool    `json:"segment"`
+	Err       bool    `json:"err"`
+	RateGuess float32 `json:"rateGuess"`
+	// Whether the segment reported a usable rate guess
+	Reporting bool `json:"reporting"`
+	// From the segment's GET /status, if it has it
+	Status *report.Status `json:"status,omitempty"`
+}
+
+// Snapshot is the state of the worm at one point in time.
+type Snapshot struct {
+	Time            time.Time `json:"time"`
+	Nodes           []Node    `json:"nodes"`
+	Segments        int       `json:"segments"`
+	TargetSegments  int32     `json:"targetSegments"`
+	KillRate        int32     `json:"killRate"`
+	AvgGuess        float32   `json:"avgGuess"`
+	Reporting       int       `json:"reporting"`
+	PartitionScheme string    `json:"partitionScheme"`
+}
+
+// Controls connects the dashboard to the visualizer.
+type Controls struct {
+	// Snapshot returns the current state.
+	Snapshot func() Snapshot
+	// Keys runs command characters, as if typed into the visualizer.
+	Keys func(keys string)
+	// Partition switches to a partition scheme by number or name.
+	Partition func(scheme string)
+	// Token must come with every command. The page is served with it.
+	Token string
+}
+
+// Token derives the command token from the shared secret. Without a secret
+// it is random, and changes every time the visualizer starts.
+func Token(secret []byte) string {
+	key := secret
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Panic(err)
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("dashboard"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Handler returns the handler for the dashboard. It sends a snapshot every
+// interval.
+func Handler(c Controls, interval time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	index := template.Must(template.ParseFS(static, "static/index.html"))
+	files := http.FileServer(mustSub(static, "static"))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+			files.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := index.Execute(w, c.Token); err != nil {
+			log.Printf("Error serving dashboard: %s", err)
+		}
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		eventsHandler(w, r, c, interval)
+	})
+	mux.HandleFunc("/command", func(w http.ResponseWriter, r *http.Request) {
+		commandHandler(w, r, c)
+	})
+	return mux
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request, c Controls, interval time.Duration) {
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(c.Snapshot())
+		if err != nil {
+			log.Printf("Error encoding snapshot: %s", err)
+			return
+		}
+		if _, err := w.Write(append(append([]byte("data: "), data...), '\n', '\n')); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// commandHandler takes a form with keys (command characters) and/or
+// partition (a scheme number or name).
+func commandHandler(w http.ResponseWriter, r *http.Request, c Controls) {
+	if r.Method != "POST" {
+		http.Error(w, "POST commands", http.StatusMethodNotAllowed)
+		return
+	}
+	if crossOrigin(r) {
+		log.Printf("Refused cross-origin dashboard command from %s", r.RemoteAddr)
+		http.Error(w, "Cross-origin commands not allowed", http.StatusForbidden)
+		return
+	}
+	given := r.Header.Get(TokenHeader)
+	if c.Token == "" || !hmac.Equal([]byte(given), []byte(c.Token)) {
+		log.Printf("Refused dashboard command from %s: bad token", r.RemoteAddr)
+		http.Error(w, "Bad or missing "+TokenHeader, http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Dashboard command from %s: %v", r.RemoteAddr, r.PostForm)
+	if keys := r.PostForm.Get("keys"); keys != "" {
+		c.Keys(keys)
+	}
+	if scheme := r.PostForm.Get("partition"); scheme != "" {
+		c.Partition(scheme)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// crossOrigin reports whether the browser says a request comes from a page
+// on another site. Clients other than browsers send neither header.
+func crossOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err != nil || u.Host != r.Host
+	}
+	return false
+}
+
+func mustSub(fsys embed.FS, dir string) http.FileSystem {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		log.Panic(err)
+	}
+	return http.FS(sub)
+}
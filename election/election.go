@@ -0,0 +1,237 @@
+// Package election elects a single coordinator among the worm segments.
+//
+// It implements the bully algorithm with terms. The segment with the highest
+// name among the live segments becomes leader and announces itself with a
+// coordinator message every round. When the leader's announcements stop for
+// longer than the timeout, the remaining segments hold a new election. Every
+// election starts a new term, and announcements from older terms are ignored,
+// so a segment never follows a leader that has since been replaced.
+//
+// A new leader is in place at most two timeouts after the old one died: one
+// to notice that it is gone, and one to wait for the coordinator message from
+// the highest remaining segment.
+package election
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Message kinds
+const (
+	Elect       = "election"
+	Coordinator = "coordinator"
+)
+
+// Message is sent between segments during elections.
+type Message struct {
+	Kind string
+	Term uint64
+	From string
+}
+
+func (m Message) String() string {
+	return fmt.Sprintf("%s %d %s", m.Kind, m.Term, m.From)
+}
+
+// ParseMessage parses a message in the format produced by String.
+func ParseMessage(s string) (Message, error) {
+	var m Message
+	pc, err := fmt.Sscanf(s, "%s %d %s", &m.Kind, &m.Term, &m.From)
+	if pc != 3 || err != nil {
+		return m, fmt.Errorf("bad election message %q: %v", s, err)
+	}
+	if m.Kind != Elect && m.Kind != Coordinator {
+		return m, fmt.Errorf("unknown election message kind %q", m.Kind)
+	}
+	return m, nil
+}
+
+// Elector holds one segment's view of the election.
+type Elector struct {
+	mu sync.Mutex
+
+	self      string
+	timeout   time.Duration
+	term      uint64
+	leader    string
+	lastHeard time.Time
+	electing  bool
+	resigned  bool
+
+	// peers returns the segments believed to be alive. It may include self.
+	peers func() []string
+	// send delivers a message to a peer and reports whether the peer
+	// answered.
+	send func(peer string, m Message) bool
+}
+
+// New creates an elector for the segment named self. It does not know of any
+// leader yet, and will hold an election on the first Tick after timeout.
+func New(self string, timeout time.Duration, now time.Time,
+	peers func() []string, send func(string, Message) bool) *Elector {
+	return &Elector{
+		self:      self,
+		timeout:   timeout,
+		lastHeard: now,
+		peers:     peers,
+		send:      send,
+	}
+}
+
+// Leader returns the current leader and term. The leader is empty if no
+// election has completed yet.
+func (e *Elector) Leader() (string, uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader, e.term
+}
+
+// IsLeader reports whether this segment is the coordinator.
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader == e.self
+}
+
+// Tick should be called once per heartbeat round. The leader announces
+// itself to all peers, everybody else checks whether the leader has gone
+// quiet.
+func (e *Elector) Tick(now time.Time) {
+	e.mu.Lock()
+	isLeader := e.leader == e.self
+	term := e.term
+	stale := now.Sub(e.lastHeard) > e.timeout
+	resigned := e.resigned
+	e.mu.Unlock()
+
+	if resigned {
+		return
+	}
+	if isLeader {
+		e.announce(term)
+	} else if stale {
+		e.elect(now)
+	}
+}
+
+// Handle processes a message from another segment.
+func (e *Elector) Handle(m Message, now time.Time) {
+	e.mu.Lock()
+	resigned := e.resigned
+	e.mu.Unlock()
+	if resigned {
+		return
+	}
+
+	switch m.Kind {
+	case Elect:
+		e.mu.Lock()
+		if m.Term > e.term {
+			e.term = m.Term
+		}
+		isLeader := e.leader == e.self
+		term := e.term
+		e.mu.Unlock()
+
+		// The sender gets its answer from the HTTP response. Take
+		// over the election, or just remind it who is in charge.
+		if isLeader {
+			go e.send(m.From, Message{Coordinator, term, e.self})
+		} else {
+			go e.elect(now)
+		}
+
+	case Coordinator:
+		e.mu.Lock()
+		if m.Term < e.term {
+			e.mu.Unlock()
+			return
+		}
+		e.term = m.Term
+		e.leader = m.From
+		e.lastHeard = now
+		e.mu.Unlock()
+
+		// A lower segment that thinks it is in charge must be bullied
+		if m.From < e.self {
+			go e.elect(now)
+		}
+	}
+}
+
+// elect starts a new term and challenges all higher segments. If none of
+// them answers, this segment becomes the leader.
+func (e *Elector) elect(now time.Time) {
+	e.mu.Lock()
+	if e.electing || e.resigned {
+		e.mu.Unlock()
+		return
+	}
+	e.electing = true
+	e.term++
+	term := e.term
+	e.mu.Unlock()
+
+	answered := false
+	for _, peer := range e.peers() {
+		if peer > e.self && e.send(peer, Message{Elect, term, e.self}) {
+			answered = true
+		}
+	}
+
+	e.mu.Lock()
+	e.electing = false
+	if e.term != term {
+		// A newer term started while we were waiting
+		e.mu.Unlock()
+		return
+	}
+	if answered {
+		// Somebody higher is alive, give it a timeout to announce
+		// itself before trying again.
+		e.lastHeard = now
+		e.mu.Unlock()
+		return
+	}
+	e.leader = e.self
+	e.lastHeard = now
+	e.mu.Unlock()
+
+	e.announce(term)
+}
+
+// Resign takes this segment out of elections for good, before it leaves. If
+// it was the leader, it starts a new term among the peers right away, so that
+// they don't have to wait for the timeout to notice it is gone. By then the
+// segment should no longer answer election messages, or the peers will wait
+// for it to take over.
+func (e *Elector) Resign() {
+	e.mu.Lock()
+	wasLeader := e.leader == e.self
+	e.resigned = true
+	e.leader = ""
+	if wasLeader {
+		e.term++
+	}
+	term := e.term
+	e.mu.Unlock()
+
+	if !wasLeader {
+		return
+	}
+	for _, peer := range e.peers() {
+		if peer != e.self {
+			e.send(peer, Message{Elect, term, e.self})
+		}
+	}
+}
+
+func (e *Elector) announce(term uint64) {
+	for _, peer := range e.peers() {
+		if peer != e.self {
+			e.send(peer, Message{Coordinator, term, e.self})
+		}
+	}
+}
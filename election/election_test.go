@@ -0,0 +1,175 @@
+package election
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+const timeout = 2 * time.Second
+
+var t0 = time.Unix(1000, 0)
+
+func at(seconds float64) time.Time {
+	return t0.Add(time.Duration(seconds * float64(time.Second)))
+}
+
+// cluster delivers messages between electors directly. Segments that are down
+// don't answer, and aren't among the peers.
+type cluster struct {
+	mu    sync.Mutex
+	nodes map[string]*Elector
+	down  map[string]bool
+	now   time.Time
+}
+
+func newCluster(names ...string) *cluster {
+	c := &cluster{nodes: make(map[string]*Elector), down: make(map[string]bool), now: t0}
+	for _, name := range names {
+		c.nodes[name] = New(name, timeout, t0, c.peers, c.send)
+	}
+	return c
+}
+
+func (c *cluster) peers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var up []string
+	for name := range c.nodes {
+		if !c.down[name] {
+			up = append(up, name)
+		}
+	}
+	sort.Strings(up)
+	return up
+}
+
+func (c *cluster) send(peer string, m Message) bool {
+	c.mu.Lock()
+	e, ok := c.nodes[peer]
+	up := ok && !c.down[peer]
+	now := c.now
+	c.mu.Unlock()
+	if !up {
+		return false
+	}
+	e.Handle(m, now)
+	return true
+}
+
+func (c *cluster) setDown(name string, down bool) {
+	c.mu.Lock()
+	c.down[name] = down
+	c.mu.Unlock()
+}
+
+// tick runs a round of one segment at the given time
+func (c *cluster) tick(name string, seconds float64) {
+	c.mu.Lock()
+	c.now = at(seconds)
+	e := c.nodes[name]
+	c.mu.Unlock()
+	e.Tick(at(seconds))
+}
+
+// waitLeader waits until all the named segments follow leader
+func (c *cluster) waitLeader(t *testing.T, leader string, names ...string) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		agree := true
+		for _, name := range names {
+			if got, _ := c.nodes[name].Leader(); got != leader {
+				agree = false
+			}
+		}
+		if agree {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, name := range names {
+				got, term := c.nodes[name].Leader()
+				t.Errorf("%s follows %q in term %d", name, got, term)
+			}
+			t.Fatalf("no agreement on leader %s", leader)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHigherTakesOver(t *testing.T) {
+	c := newCluster("a", "b", "c")
+	c.setDown("c", true)
+	c.tick("b", 3)
+	c.waitLeader(t, "b", "a", "b")
+
+	// c comes back and hears from b, which it outranks
+	c.setDown("c", false)
+	c.tick("b", 3.5)
+	c.waitLeader(t, "c", "a", "b", "c")
+	_, first := c.nodes["a"].Leader()
+	if _, term := c.nodes["c"].Leader(); term <= 1 || term != first {
+		t.Errorf("c leads term %d, a is in term %d", term, first)
+	}
+}
+
+func TestLowerDefers(t *testing.T) {
+	c := newCluster("a", "b")
+
+	// a notices first, but b answers, and wins
+	c.tick("a", 3)
+	c.waitLeader(t, "b", "a", "b")
+	if c.nodes["a"].IsLeader() {
+		t.Errorf("a leads, with b alive")
+	}
+
+	// Nor does a try again while b keeps announcing itself
+	_, term := c.nodes["b"].Leader()
+	for round := 0.5; round < 5; round += 0.5 {
+		c.tick("b", 3+round)
+		c.tick("a", 3+round)
+	}
+	c.waitLeader(t, "b", "a", "b")
+	if _, now := c.nodes["a"].Leader(); now != term {
+		t.Errorf("term went from %d to %d under a steady leader", term, now)
+	}
+}
+
+func TestStaleTerm(t *testing.T) {
+	c := newCluster("a")
+	a := c.nodes["a"]
+	a.Handle(Message{Coordinator, 5, "c"}, at(1))
+	a.Handle(Message{Coordinator, 3, "d"}, at(2))
+	if leader, term := a.Leader(); leader != "c" || term != 5 {
+		t.Errorf("leader %s in term %d after a stale announcement, want c in term 5", leader, term)
+	}
+
+	// The leader of the current term can still announce itself
+	a.Handle(Message{Coordinator, 5, "c"}, at(3))
+	a.Handle(Message{Coordinator, 6, "d"}, at(4))
+	if leader, term := a.Leader(); leader != "d" || term != 6 {
+		t.Errorf("leader %s in term %d, want d in term 6", leader, term)
+	}
+}
+
+func TestResign(t *testing.T) {
+	c := newCluster("a", "b", "c")
+	c.tick("c", 3)
+	c.waitLeader(t, "c", "a", "b", "c")
+	_, term := c.nodes["c"].Leader()
+
+	// c stops answering, then hands over without waiting for the timeout
+	c.setDown("c", true)
+	c.nodes["c"].Resign()
+	c.waitLeader(t, "b", "a", "b")
+	if _, newTerm := c.nodes["b"].Leader(); newTerm <= term {
+		t.Errorf("b leads term %d, not after c's term %d", newTerm, term)
+	}
+
+	// c is out of elections for good
+	c.nodes["c"].Handle(Message{Coordinator, term + 10, "b"}, at(4))
+	c.tick("c", 10)
+	if leader, _ := c.nodes["c"].Leader(); leader != "" || c.nodes["c"].IsLeader() {
+		t.Errorf("c follows %q after resigning", leader)
+	}
+}
@@ -0,0 +1,7 @@
+// Package integration runs the worm end to end in a simulated cluster.
+//
+// The tests build the simulator, the worm gate and the segment from the
+// repository root, start a cluster of worm gates on 127.0.0.1 and drive the
+// worm through its HTTP API. They take a while, so `go test -short` skips
+// them.
+package integration
@@ -0,0 +1,208 @@
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Ports of the first simulated node, away from the ones in the README so that
+// the test doesn't run into a cluster someone is playing with. Node i adds
+// 10*i.
+const (
+	nodes        = 6
+	wormgatePort = 19181
+	segmentPort  = 19182
+)
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// build compiles the main files in the repository root into dir
+func build(t *testing.T, dir string) {
+	for _, name := range []string{"sim", "wormgate", "segment"} {
+		cmd := exec.Command("go", "build", "-o", filepath.Join(dir, name), name+".go")
+		cmd.Dir = ".."
+		cmd.Env = append(os.Environ(), "GO111MODULE=off")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("building %s: %s\n%s", name, err, out)
+		}
+	}
+}
+
+func gateURL(i int, path string) string {
+	return fmt.Sprintf("http://127.0.0.1:%d%s", wormgatePort+10*i, path)
+}
+
+func segmentURL(i int, path string) string {
+	return fmt.Sprintf("http://127.0.0.1:%d%s", segmentPort+10*i, path)
+}
+
+// running counts the nodes with a segment that answers
+func running() int {
+	quick := &http.Client{Timeout: time.Second}
+	n := 0
+	for i := 0; i < nodes; i++ {
+		resp, err := quick.Get(segmentURL(i, "/"))
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// waitFor polls until check holds, or fails the test after timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, check func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %s waiting for %s", timeout, what)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func post(url, body string) (int, string, error) {
+	resp, err := client.Post(url, "text/plain", strings.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(data), err
+}
+
+// TestShutdownUnderKillRate shuts the worm down while segments keep being
+// killed and respawned, and checks that it stays down.
+func TestShutdownUnderKillRate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a simulated cluster")
+	}
+	dir, err := ioutil.TempDir("", "worm-integration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	build(t, dir)
+
+	var simOutput bytes.Buffer
+	sim := exec.Command(filepath.Join(dir, "sim"), "-n", fmt.Sprint(nodes),
+		"-wp", fmt.Sprintf(":%d", wormgatePort), "-sp", fmt.Sprintf(":%d", segmentPort),
+		"--", "-path", filepath.Join(dir, "gates"), "-grace", "1s")
+	sim.Stdout = &simOutput
+	sim.Stderr = &simOutput
+	if err := sim.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		sim.Process.Signal(syscall.SIGTERM)
+		sim.Wait()
+		if t.Failed() {
+			t.Logf("simulator output:\n%s", simOutput.String())
+		}
+	}()
+
+	waitFor(t, 10*time.Second, "the worm gates", func() bool {
+		for i := 0; i < nodes; i++ {
+			resp, err := client.Get(gateURL(i, "/"))
+			if err != nil {
+				return false
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		return true
+	})
+
+	spread := exec.Command(filepath.Join(dir, "segment"), "spread",
+		"-wp", fmt.Sprintf(":%d", wormgatePort), "-sp", fmt.Sprintf(":%d", segmentPort),
+		"-host", "compute-1-0")
+	spread.Env = append(os.Environ(), fmt.Sprintf("WORM_SIM=%d", nodes))
+	if out, err := spread.CombinedOutput(); err != nil {
+		t.Fatalf("segment spread: %s\n%s", err, out)
+	}
+	waitFor(t, 10*time.Second, "the first segment", func() bool { return running() == 1 })
+	if status, body, err := post(segmentURL(0, "/targetsegments"), fmt.Sprint(nodes)); err != nil || status != 200 {
+		t.Fatalf("setting the target: %d %q %v", status, body, err)
+	}
+	waitFor(t, 30*time.Second, "the worm to grow", func() bool { return running() == nodes })
+
+	// Kill a random segment every half second, as the visualizer would
+	stop := make(chan struct{})
+	var killer sync.WaitGroup
+	killer.Add(1)
+	go func() {
+		defer killer.Done()
+		quick := &http.Client{Timeout: time.Second}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(500 * time.Millisecond):
+			}
+			url := gateURL(rand.Intn(nodes), fmt.Sprintf("/killsegment?id=:%d", segmentPort))
+			if resp, err := quick.Post(url, "text/plain", nil); err == nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}
+	}()
+	time.Sleep(3 * time.Second)
+
+	// Any segment can shut the worm down, ask the first one that is up
+	var summary string
+	waitFor(t, 20*time.Second, "a segment to take the shutdown", func() bool {
+		for i := 0; i < nodes; i++ {
+			status, body, err := post(segmentURL(i, "/shutdown"), "")
+			if err == nil && status == 200 {
+				summary = body
+				return true
+			}
+		}
+		return false
+	})
+	t.Logf("shutdown summary:\n%s", summary)
+
+	// Once the tombstones are out, nothing comes back, kills or not
+	waitFor(t, 15*time.Second, "all segments to stop", func() bool { return running() == 0 })
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Second)
+		if n := running(); n != 0 {
+			t.Fatalf("%d segments running %ds after the worm stopped", n, i+1)
+		}
+	}
+	close(stop)
+	killer.Wait()
+
+	// Every worm gate refuses the worm's segments from now on
+	for i := 0; i < nodes; i++ {
+		resp, err := client.Get(gateURL(i, "/tombstone"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var id string
+		var epoch int64
+		if _, err := fmt.Sscanf(string(data), "%s %d", &id, &epoch); err != nil || id != fmt.Sprintf(":%d", segmentPort) {
+			t.Fatalf("node %d: no tombstone for the worm: %q", i, data)
+		}
+		url := gateURL(i, fmt.Sprintf("/wormgate?sp=:%d&id=:%d&epoch=%d", segmentPort, segmentPort, epoch))
+		status, body, err := post(url, "")
+		if err != nil || status != http.StatusGone {
+			t.Errorf("node %d: spreading the worm again: %d %q %v, want 410", i, status, body, err)
+		}
+	}
+}
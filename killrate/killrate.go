@@ -0,0 +1,182 @@
+// Package killrate estimates how often segments of the worm are being killed.
+//
+// Every segment feeds the deaths it observes itself into an Estimator and
+// periodically exchanges its recent observations with its peers. Since all
+// segments end up with the same set of deaths, their estimates converge to a
+// common, cluster-wide kill rate.
+package killrate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Death is a single observed segment death. A segment is identified by its
+// host and its incarnation in the membership list, so that every segment
+// that sees the same death agrees on it, and a new segment on the same host
+// dies a death of its own.
+type Death struct {
+	Host        string
+	Incarnation uint64
+	Time        time.Time
+}
+
+// Estimator keeps the deaths seen within a sliding window.
+type Estimator struct {
+	mu sync.Mutex
+
+	window time.Duration
+	since  time.Time
+	deaths []Death // sorted by time
+}
+
+// New creates an estimator with the given sliding window.
+func New(window time.Duration, now time.Time) *Estimator {
+	return &Estimator{
+		window: window,
+		since:  now,
+	}
+}
+
+// Observe records a death seen by this segment. It returns false if the
+// death was already known.
+func (e *Estimator) Observe(host string, incarnation uint64, t time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.add(Death{host, incarnation, t})
+}
+
+// Merge adds deaths reported by a peer that has been observing since the
+// given time. It returns the number of deaths that were new to us.
+func (e *Estimator) Merge(since time.Time, deaths []Death) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if since.Before(e.since) {
+		e.since = since
+	}
+	added := 0
+	for _, d := range deaths {
+		if e.add(d) {
+			added++
+		}
+	}
+	return added
+}
+
+func (e *Estimator) add(d Death) bool {
+	for _, known := range e.deaths {
+		if known.Host == d.Host && known.Incarnation == d.Incarnation {
+			return false
+		}
+	}
+	i := sort.Search(len(e.deaths), func(i int) bool {
+		return e.deaths[i].Time.After(d.Time)
+	})
+	e.deaths = append(e.deaths, Death{})
+	copy(e.deaths[i+1:], e.deaths[i:])
+	e.deaths[i] = d
+	return true
+}
+
+// expire drops deaths that have fallen out of the window.
+func (e *Estimator) expire(now time.Time) {
+	cutoff := now.Add(-e.window)
+	i := sort.Search(len(e.deaths), func(i int) bool {
+		return e.deaths[i].Time.After(cutoff)
+	})
+	e.deaths = e.deaths[i:]
+}
+
+// Recent returns the deaths within the window, oldest first, and the time
+// this estimator has been observing since.
+func (e *Estimator) Recent(now time.Time) (time.Time, []Death) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.expire(now)
+	deaths := make([]Death, len(e.deaths))
+	copy(deaths, e.deaths)
+	return e.since, deaths
+}
+
+// Estimate returns the kill rate in deaths per second, and a confidence
+// between 0 and 1.
+//
+// Confidence grows with how much of the window has actually been observed
+// and with the number of deaths in it (the relative error of a Poisson count
+// is 1/sqrt(n)). With no deaths at all it stays at zero.
+func (e *Estimator) Estimate(now time.Time) (rate, confidence float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.expire(now)
+
+	observed := now.Sub(e.since)
+	if observed > e.window {
+		observed = e.window
+	}
+	if observed <= 0 {
+		return 0, 0
+	}
+
+	n := float64(len(e.deaths))
+	rate = n / observed.Seconds()
+	coverage := float64(observed) / float64(e.window)
+	confidence = coverage * (1 - 1/math.Sqrt(n+1))
+	return rate, confidence
+}
+
+// Encode writes the observations in the plain text format exchanged between
+// segments: a line with the observation start time, then one
+// `<host> <incarnation> <time>` line per death. Times are Unix nanoseconds.
+func Encode(w io.Writer, since time.Time, deaths []Death) error {
+	_, err := fmt.Fprintf(w, "since %d\n", since.UnixNano())
+	for _, d := range deaths {
+		if err != nil {
+			break
+		}
+		_, err = fmt.Fprintf(w, "%s %d %d\n", d.Host, d.Incarnation, d.Time.UnixNano())
+	}
+	return err
+}
+
+// Decode parses observations written by Encode.
+func Decode(r io.Reader) (time.Time, []Death, error) {
+	var since time.Time
+	var deaths []Death
+
+	scanner := bufio.NewScanner(r)
+	first := true
+	for scanner.Scan() {
+		var ns int64
+		if first {
+			pc, err := fmt.Sscanf(scanner.Text(), "since %d", &ns)
+			if pc != 1 || err != nil {
+				return since, deaths, fmt.Errorf("missing since line")
+			}
+			since = time.Unix(0, ns)
+			first = false
+			continue
+		}
+		var d Death
+		pc, err := fmt.Sscanf(scanner.Text(), "%s %d %d", &d.Host, &d.Incarnation, &ns)
+		if pc != 3 || err != nil {
+			return since, deaths, fmt.Errorf("bad line %q: %v", scanner.Text(), err)
+		}
+		d.Time = time.Unix(0, ns)
+		deaths = append(deaths, d)
+	}
+	if err := scanner.Err(); err != nil {
+		return since, deaths, err
+	}
+	if first {
+		return since, deaths, fmt.Errorf("missing since line")
+	}
+	return since, deaths, nil
+}
@@ -0,0 +1,145 @@
+package killrate
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+var t0 = time.Unix(1000, 0)
+
+func at(seconds float64) time.Time {
+	return t0.Add(time.Duration(seconds * float64(time.Second)))
+}
+
+func TestObserveDedup(t *testing.T) {
+	e := New(30*time.Second, t0)
+	if !e.Observe("compute-1-1", 1, at(5)) {
+		t.Fatal("first death not new")
+	}
+	// The same death, seen by another segment much later
+	if e.Observe("compute-1-1", 1, at(8)) {
+		t.Error("same incarnation counted again")
+	}
+	// A new segment on the same host, dying right away
+	if !e.Observe("compute-1-1", 2, at(5.1)) {
+		t.Error("death of a new incarnation not counted")
+	}
+	if !e.Observe("compute-2-1", 1, at(5)) {
+		t.Error("death of another host at the same time not counted")
+	}
+	if _, deaths := e.Recent(at(10)); len(deaths) != 3 {
+		t.Errorf("got %d deaths, want 3", len(deaths))
+	}
+}
+
+func TestWindowExpiry(t *testing.T) {
+	e := New(10*time.Second, t0)
+	for i := 0; i < 5; i++ {
+		e.Observe("compute-1-1", uint64(i), at(float64(2*i)))
+	}
+	_, deaths := e.Recent(at(15))
+	// Only the deaths at 6 and 8 are less than 10s old
+	if len(deaths) != 2 {
+		t.Fatalf("got %d deaths in the window, want 2: %v", len(deaths), deaths)
+	}
+	if !deaths[0].Time.Before(deaths[1].Time) {
+		t.Errorf("deaths not oldest first: %v", deaths)
+	}
+	if rate, _ := e.Estimate(at(25)); rate != 0 {
+		t.Errorf("rate %g after all deaths expired, want 0", rate)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := New(30*time.Second, at(10))
+	a.Observe("compute-1-1", 7, at(12))
+
+	since, deaths := New(30*time.Second, t0).Recent(t0)
+	deaths = append(deaths,
+		Death{"compute-1-1", 7, at(12.2)}, // the same death
+		Death{"compute-2-2", 3, at(13)})
+	if added := a.Merge(since, deaths); added != 1 {
+		t.Errorf("merge added %d deaths, want 1", added)
+	}
+	// The peer has been observing longer than we have
+	if since, _ := a.Recent(at(20)); !since.Equal(t0) {
+		t.Errorf("since %v after merge, want %v", since, t0)
+	}
+	// Merging again changes nothing
+	if added := a.Merge(since, deaths); added != 0 {
+		t.Errorf("second merge added %d deaths, want 0", added)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	window := 20 * time.Second
+	e := New(window, t0)
+
+	if rate, confidence := e.Estimate(at(10)); rate != 0 || confidence != 0 {
+		t.Errorf("no deaths: got %g, %g, want 0, 0", rate, confidence)
+	}
+
+	// A death every 2 seconds for the first 10 seconds
+	for i := 0; i < 5; i++ {
+		e.Observe("compute-1-1", uint64(i), at(float64(2*i)))
+	}
+	rate, confidence := e.Estimate(at(10))
+	if math.Abs(rate-0.5) > 1e-9 {
+		t.Errorf("rate %g, want 0.5", rate)
+	}
+	// Half the window observed, 5 deaths
+	want := 0.5 * (1 - 1/math.Sqrt(6))
+	if math.Abs(confidence-want) > 1e-9 {
+		t.Errorf("confidence %g, want %g", confidence, want)
+	}
+
+	// Once the whole window has been observed, only the count matters
+	e.Observe("compute-1-1", 5, at(18))
+	_, confidence = e.Estimate(at(20))
+	n := 5.0 // the death at 0 has expired
+	want = 1 - 1/math.Sqrt(n+1)
+	if math.Abs(confidence-want) > 1e-9 {
+		t.Errorf("confidence %g with the window full, want %g", confidence, want)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	deaths := []Death{{"compute-1-1", 4, at(1)}, {"compute-2-2", 1 << 62, at(2.5)}}
+	var buf bytes.Buffer
+	if err := Encode(&buf, t0, deaths); err != nil {
+		t.Fatal(err)
+	}
+	since, got, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !since.Equal(t0) {
+		t.Errorf("since %v, want %v", since, t0)
+	}
+	if len(got) != len(deaths) {
+		t.Fatalf("got %d deaths, want %d", len(got), len(deaths))
+	}
+	for i := range deaths {
+		if got[i].Host != deaths[i].Host || got[i].Incarnation != deaths[i].Incarnation ||
+			!got[i].Time.Equal(deaths[i].Time) {
+			t.Errorf("death %d: got %v, want %v", i, got[i], deaths[i])
+		}
+	}
+}
+
+func TestDecodeBad(t *testing.T) {
+	for _, body := range []string{
+		"",
+		"compute-1-1 123\n",
+		"since soon\n",
+		"since 123\ncompute-1-1\n",
+		"since 123\ncompute-1-1 123\n",
+	} {
+		if _, _, err := Decode(strings.NewReader(body)); err == nil {
+			t.Errorf("no error decoding %q", body)
+		}
+	}
+}
@@ -0,0 +1,572 @@
+// Package membership keeps track of which worm segments are alive.
+//
+// It is a variant of the SWIM protocol. Every protocol round, a segment pings
+// one member, picked round-robin from a shuffled list. If the member does not
+// answer, it asks a few other members to ping it on its behalf (ping-req). If
+// none of those get an answer either, the member is suspected, and declared
+// dead when nobody refutes the suspicion within the suspicion timeout.
+//
+// Membership changes are not broadcast. They are piggybacked on the pings and
+// their answers, each change a limited number of times. A segment therefore
+// sends a bounded number of requests per round, no matter how many hosts
+// there are.
+//
+// SWIM normally treats death as final. Here, a dead host comes back when a
+// new segment is started on it: every segment process starts with its start
+// time as incarnation number, so its Alive update supersedes the Dead update
+// of the previous segment on the same host. A segment that was declared dead
+// while it was out of reach comes back when it is discovered again: it is
+// told that it was declared dead, and refutes that like any suspicion.
+//
+// A segment that goes of its own accord announces that it left rather than
+// died. It is gone all the same, but OnDeath can tell the two apart.
+package membership
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State of a member
+type State int
+
+const (
+	Alive State = iota
+	Suspect
+	Dead
+	Left
+)
+
+var stateNames = []string{"alive", "suspect", "dead", "left"}
+
+// gone tells whether a member in the state is no longer part of the worm
+func (s State) gone() bool {
+	return s == Dead || s == Left
+}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+func parseState(s string) (State, error) {
+	for i, name := range stateNames {
+		if name == s {
+			return State(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown member state %q", s)
+}
+
+// Update is a membership change, as passed around between segments.
+type Update struct {
+	Host        string
+	State       State
+	Incarnation uint64
+}
+
+// Message is a ping or an answer to one. It carries piggybacked updates.
+type Message struct {
+	From    string
+	Updates []Update
+}
+
+// Encode writes the message in the plain text format exchanged between
+// segments: a `from <host>` line followed by one
+// `<state> <host> <incarnation>` line per update.
+func (m Message) Encode(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "from %s\n", m.From)
+	for _, u := range m.Updates {
+		if err != nil {
+			break
+		}
+		_, err = fmt.Fprintf(w, "%s %s %d\n", u.State, u.Host, u.Incarnation)
+	}
+	return err
+}
+
+// DecodeMessage parses a message written by Encode.
+func DecodeMessage(r io.Reader) (Message, error) {
+	var m Message
+	scanner := bufio.NewScanner(r)
+	first := true
+	for scanner.Scan() {
+		line := scanner.Text()
+		if first {
+			pc, err := fmt.Sscanf(line, "from %s", &m.From)
+			if pc != 1 || err != nil {
+				return m, fmt.Errorf("bad message header %q: %v", line, err)
+			}
+			first = false
+			continue
+		}
+		var state string
+		var u Update
+		pc, err := fmt.Sscanf(line, "%s %s %d", &state, &u.Host, &u.Incarnation)
+		if pc != 3 || err != nil {
+			return m, fmt.Errorf("bad update %q: %v", line, err)
+		}
+		u.State, err = parseState(state)
+		if err != nil {
+			return m, err
+		}
+		m.Updates = append(m.Updates, u)
+	}
+	if first && scanner.Err() == nil {
+		return m, fmt.Errorf("empty message")
+	}
+	return m, scanner.Err()
+}
+
+// Config holds the protocol parameters.
+type Config struct {
+	// IndirectProbes is the number of members asked to ping a member that
+	// did not answer a direct ping.
+	IndirectProbes int
+	// SuspectTimeout is how long a member stays suspected before it is
+	// declared dead.
+	SuspectTimeout time.Duration
+	// JoinTimeout is how long a host given to Join is probed before giving
+	// up on it.
+	JoinTimeout time.Duration
+	// MaxPiggyback is the maximum number of updates carried per message.
+	MaxPiggyback int
+	// RetransmitMult scales the number of times each update is
+	// piggybacked, which is RetransmitMult * log(members).
+	RetransmitMult int
+}
+
+// DefaultConfig has parameters suited for a few hundred hosts and a protocol
+// round of about half a second.
+var DefaultConfig = Config{
+	IndirectProbes: 3,
+	SuspectTimeout: 3 * time.Second,
+	JoinTimeout:    10 * time.Second,
+	MaxPiggyback:   16,
+	RetransmitMult: 3,
+}
+
+// Transport sends protocol messages to other segments.
+type Transport interface {
+	// Ping sends a ping to host and returns its answer. ok is false if
+	// the host did not answer.
+	Ping(host string, m Message) (ack Message, ok bool)
+	// PingReq asks via to ping target on our behalf, and returns the
+	// answer of target, if any.
+	PingReq(via, target string, m Message) (ack Message, ok bool)
+}
+
+type member struct {
+	state       State
+	incarnation uint64
+	changed     time.Time
+}
+
+type broadcast struct {
+	update    Update
+	transmits int
+}
+
+// List is one segment's view of the membership.
+type List struct {
+	mu sync.Mutex
+
+	self        string
+	incarnation uint64
+	cfg         Config
+	transport   Transport
+
+	members    map[string]*member
+	queue      []*broadcast
+	probeOrder []string
+	joining    map[string]time.Time
+
+	// OnDeath, if set, is called when a member is declared dead, either
+	// by us or by gossip from other segments. The incarnation is the one
+	// that was declared dead. left is true if the member left by itself.
+	OnDeath func(host string, incarnation uint64, left bool)
+}
+
+// New creates a membership list that initially only contains self.
+func New(self string, cfg Config, transport Transport, now time.Time) *List {
+	l := &List{
+		self:        self,
+		incarnation: uint64(now.UnixNano()),
+		cfg:         cfg,
+		transport:   transport,
+		members:     make(map[string]*member),
+		joining:     make(map[string]time.Time),
+	}
+	l.members[self] = &member{Alive, l.incarnation, now}
+	return l
+}
+
+// Alive returns the hosts that are alive or suspected, including self,
+// sorted by name.
+func (l *List) Alive() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var hosts []string
+	for host, m := range l.members {
+		if !m.state.gone() {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Members returns the state of every known host.
+func (l *List) Members() map[string]State {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	states := make(map[string]State, len(l.members))
+	for host, m := range l.members {
+		states[host] = m.state
+	}
+	return states
+}
+
+// Join makes the list probe host every round until it answers or the join
+// timeout runs out. Use it for hosts where we have just started a segment.
+func (l *List) Join(host string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if m, ok := l.members[host]; !ok || m.state.gone() {
+		l.joining[host] = now
+	}
+}
+
+// Tick runs one protocol round. candidates are the hosts that may run a
+// segment we don't know about yet; one of them is probed per round, so that
+// separate groups of segments find each other.
+func (l *List) Tick(now time.Time, candidates []string) {
+	l.expireSuspects(now)
+
+	if target := l.nextProbe(); target != "" {
+		l.probe(target, now)
+	}
+
+	for _, host := range l.joiners(now) {
+		l.discover(host, now)
+	}
+
+	var strangers []string
+	l.mu.Lock()
+	for _, host := range candidates {
+		m, ok := l.members[host]
+		if host != l.self && (!ok || m.state.gone()) {
+			strangers = append(strangers, host)
+		}
+	}
+	l.mu.Unlock()
+	if len(strangers) > 0 {
+		l.discover(strangers[rand.Intn(len(strangers))], now)
+	}
+}
+
+// HandlePing processes a ping from another segment and returns the answer.
+// A sender we did not know gets our full membership, so that a new segment
+// learns about everybody from its first exchange.
+func (l *List) HandlePing(m Message, now time.Time) Message {
+	l.mu.Lock()
+	_, known := l.members[m.From]
+	known = known && !l.members[m.From].state.gone()
+	l.mu.Unlock()
+
+	l.merge(m.Updates, now)
+
+	if known {
+		return l.message()
+	}
+	return l.fullMessage()
+}
+
+// HandlePingReq pings target on behalf of another segment.
+func (l *List) HandlePingReq(target string, m Message, now time.Time) (Message, bool) {
+	l.merge(m.Updates, now)
+	ack, ok := l.transport.Ping(target, l.message())
+	if ok {
+		l.merge(ack.Updates, now)
+	}
+	return ack, ok
+}
+
+// Leave marks self as gone and tries to tell a few members before we go. A
+// voluntary leave is announced as Left, otherwise we are Dead like any member
+// that was killed.
+func (l *List) Leave(now time.Time, voluntary bool) {
+	state := Dead
+	if voluntary {
+		state = Left
+	}
+	l.mu.Lock()
+	l.members[l.self] = &member{state, l.incarnation, now}
+	l.enqueue(Update{l.self, state, l.incarnation})
+	var peers []string
+	for host, m := range l.members {
+		if host != l.self && !m.state.gone() {
+			peers = append(peers, host)
+		}
+	}
+	l.mu.Unlock()
+
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > l.cfg.IndirectProbes {
+		peers = peers[:l.cfg.IndirectProbes]
+	}
+	for _, host := range peers {
+		l.transport.Ping(host, l.message())
+	}
+}
+
+// probe pings target directly, then indirectly, and suspects it if all
+// attempts fail.
+func (l *List) probe(target string, now time.Time) {
+	if ack, ok := l.transport.Ping(target, l.message()); ok {
+		l.merge(ack.Updates, now)
+		return
+	}
+
+	for _, via := range l.helpers(target) {
+		if ack, ok := l.transport.PingReq(via, target, l.message()); ok {
+			l.merge(ack.Updates, now)
+			return
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if m, ok := l.members[target]; ok && m.state == Alive {
+		l.setState(target, m, Suspect, m.incarnation, now)
+	}
+}
+
+// discover pings a host that is not a member (yet), sending it everything
+// we know, and that it is dead if we think so.
+func (l *List) discover(host string, now time.Time) {
+	m := l.fullMessage()
+	l.mu.Lock()
+	if mem, ok := l.members[host]; ok && mem.state.gone() {
+		m.Updates = append(m.Updates, Update{host, mem.state, mem.incarnation})
+	}
+	l.mu.Unlock()
+
+	ack, ok := l.transport.Ping(host, m)
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	delete(l.joining, host)
+	l.mu.Unlock()
+	l.merge(ack.Updates, now)
+}
+
+func (l *List) joiners(now time.Time) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var hosts []string
+	for host, since := range l.joining {
+		m, ok := l.members[host]
+		if now.Sub(since) > l.cfg.JoinTimeout || (ok && !m.state.gone()) {
+			delete(l.joining, host)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// nextProbe returns the next member to ping, refilling and reshuffling the
+// probe order when it runs out.
+func (l *List) nextProbe() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for refilled := false; ; {
+		for len(l.probeOrder) > 0 {
+			host := l.probeOrder[0]
+			l.probeOrder = l.probeOrder[1:]
+			if m, ok := l.members[host]; ok && !m.state.gone() {
+				return host
+			}
+		}
+		if refilled {
+			return ""
+		}
+		for host, m := range l.members {
+			if host != l.self && !m.state.gone() {
+				l.probeOrder = append(l.probeOrder, host)
+			}
+		}
+		rand.Shuffle(len(l.probeOrder), func(i, j int) {
+			l.probeOrder[i], l.probeOrder[j] = l.probeOrder[j], l.probeOrder[i]
+		})
+		refilled = true
+	}
+}
+
+// helpers picks the members to ask for an indirect ping of target.
+func (l *List) helpers(target string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var hosts []string
+	for host, m := range l.members {
+		if host != l.self && host != target && m.state == Alive {
+			hosts = append(hosts, host)
+		}
+	}
+	rand.Shuffle(len(hosts), func(i, j int) { hosts[i], hosts[j] = hosts[j], hosts[i] })
+	if len(hosts) > l.cfg.IndirectProbes {
+		hosts = hosts[:l.cfg.IndirectProbes]
+	}
+	return hosts
+}
+
+func (l *List) expireSuspects(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for host, m := range l.members {
+		if m.state == Suspect && now.Sub(m.changed) > l.cfg.SuspectTimeout {
+			l.setState(host, m, Dead, m.incarnation, now)
+		}
+	}
+}
+
+// merge applies updates received from another segment.
+func (l *List) merge(updates []Update, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, u := range updates {
+		if u.Host == l.self {
+			// Refute rumours of our death
+			if u.State != Alive && u.Incarnation >= l.incarnation &&
+				!l.members[l.self].state.gone() {
+				l.incarnation = u.Incarnation + 1
+				l.members[l.self].incarnation = l.incarnation
+				l.enqueue(Update{l.self, Alive, l.incarnation})
+			}
+			continue
+		}
+
+		m, ok := l.members[u.Host]
+		if !ok {
+			if u.State.gone() {
+				continue
+			}
+			m = &member{Dead, 0, now}
+			l.members[u.Host] = m
+		}
+		if overrides(u, m) {
+			l.setState(u.Host, m, u.State, u.Incarnation, now)
+		}
+	}
+}
+
+// overrides tells whether an update supersedes what we know about a member.
+func overrides(u Update, m *member) bool {
+	switch u.State {
+	case Alive:
+		return u.Incarnation > m.incarnation
+	case Suspect:
+		if m.state.gone() {
+			return u.Incarnation > m.incarnation
+		}
+		return u.Incarnation > m.incarnation ||
+			(u.Incarnation == m.incarnation && m.state == Alive)
+	case Dead, Left:
+		return !m.state.gone() && u.Incarnation >= m.incarnation
+	}
+	return false
+}
+
+// setState changes a member and queues the change for gossip. Must be called
+// with the lock held.
+func (l *List) setState(host string, m *member, state State, incarnation uint64, now time.Time) {
+	died := state.gone() && !m.state.gone()
+	m.state = state
+	m.incarnation = incarnation
+	m.changed = now
+	l.enqueue(Update{host, state, incarnation})
+
+	if died && l.OnDeath != nil {
+		go l.OnDeath(host, incarnation, state == Left)
+	}
+}
+
+// enqueue adds an update to the piggyback queue, replacing older news about
+// the same host. Must be called with the lock held.
+func (l *List) enqueue(u Update) {
+	for i, b := range l.queue {
+		if b.update.Host == u.Host {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			break
+		}
+	}
+	l.queue = append(l.queue, &broadcast{u, 0})
+}
+
+// message builds a message carrying the least transmitted updates.
+func (l *List) message() Message {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.cfg.RetransmitMult * int(math.Ceil(math.Log10(float64(len(l.members)+1))))
+	if limit < 1 {
+		limit = 1
+	}
+
+	sort.SliceStable(l.queue, func(i, j int) bool {
+		return l.queue[i].transmits < l.queue[j].transmits
+	})
+
+	m := Message{From: l.self}
+	m.Updates = append(m.Updates, Update{l.self, l.members[l.self].state, l.incarnation})
+	for _, b := range l.queue {
+		if len(m.Updates) >= l.cfg.MaxPiggyback {
+			break
+		}
+		if b.update.Host == l.self {
+			continue
+		}
+		m.Updates = append(m.Updates, b.update)
+		b.transmits++
+	}
+
+	kept := l.queue[:0]
+	for _, b := range l.queue {
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	l.queue = kept
+	return m
+}
+
+// fullMessage builds a message carrying every live member.
+func (l *List) fullMessage() Message {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m := Message{From: l.self}
+	for host, mem := range l.members {
+		if !mem.state.gone() {
+			m.Updates = append(m.Updates, Update{host, mem.state, mem.incarnation})
+		}
+	}
+	return m
+}
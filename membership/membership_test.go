@@ -0,0 +1,282 @@
+package membership
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+var t0 = time.Unix(1000, 0)
+
+func at(seconds float64) time.Time {
+	return t0.Add(time.Duration(seconds * float64(time.Second)))
+}
+
+// network delivers messages between lists directly. Hosts that are down
+// don't answer, and neither do hosts cut off from the sender.
+type network struct {
+	mu    sync.Mutex
+	lists map[string]*List
+	down  map[string]bool
+	cuts  map[[2]string]bool
+	now   time.Time
+}
+
+func newNetwork() *network {
+	return &network{lists: make(map[string]*List), down: make(map[string]bool),
+		cuts: make(map[[2]string]bool), now: t0}
+}
+
+func (n *network) setDown(host string, down bool) {
+	n.mu.Lock()
+	n.down[host] = down
+	n.mu.Unlock()
+}
+
+// cut breaks the link between two hosts, both ways
+func (n *network) cut(a, b string) {
+	n.mu.Lock()
+	n.cuts[[2]string{a, b}] = true
+	n.cuts[[2]string{b, a}] = true
+	n.mu.Unlock()
+}
+
+func (n *network) add(host string) *List {
+	l := New(host, DefaultConfig, transport{n}, n.now)
+	n.lists[host] = l
+	return l
+}
+
+// tick runs a protocol round of l at the given time, which is also the time
+// the other lists see its messages at
+func (n *network) tick(l *List, seconds float64, candidates ...string) {
+	n.mu.Lock()
+	n.now = at(seconds)
+	n.mu.Unlock()
+	l.Tick(at(seconds), candidates)
+}
+
+// list returns the list of host, if from can reach it, and the current time
+func (n *network) list(from, host string) (*List, time.Time, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l := n.lists[host]
+	return l, n.now, l != nil && !n.down[host] && !n.cuts[[2]string{from, host}]
+}
+
+type transport struct {
+	n *network
+}
+
+func (t transport) Ping(host string, m Message) (Message, bool) {
+	l, now, ok := t.n.list(m.From, host)
+	if !ok {
+		return Message{}, false
+	}
+	return l.HandlePing(m, now), true
+}
+
+func (t transport) PingReq(via, target string, m Message) (Message, bool) {
+	l, now, ok := t.n.list(m.From, via)
+	if !ok {
+		return Message{}, false
+	}
+	return l.HandlePingReq(target, m, now)
+}
+
+// deaths records what OnDeath reports
+type deaths struct {
+	mu   sync.Mutex
+	seen map[string]bool
+	done chan struct{}
+}
+
+func watch(l *List) *deaths {
+	d := &deaths{seen: make(map[string]bool), done: make(chan struct{}, 10)}
+	l.OnDeath = func(host string, incarnation uint64, left bool) {
+		d.mu.Lock()
+		d.seen[host] = left
+		d.mu.Unlock()
+		d.done <- struct{}{}
+	}
+	return d
+}
+
+func (d *deaths) wait(t *testing.T) {
+	select {
+	case <-d.done:
+	case <-time.After(time.Second):
+		t.Fatal("OnDeath not called")
+	}
+}
+
+func TestLeave(t *testing.T) {
+	for _, voluntary := range []bool{false, true} {
+		n := newNetwork()
+		a := n.add("a")
+		b := n.add("b")
+		a.Join("b", n.now)
+		n.tick(a, 0.5, "b")
+		if alive := b.Alive(); len(alive) != 2 {
+			t.Fatalf("b knows %v after a joined", alive)
+		}
+
+		d := watch(b)
+		a.Leave(at(1), voluntary)
+		d.wait(t)
+		if left, ok := d.seen["a"]; !ok || left != voluntary {
+			t.Errorf("voluntary %v: OnDeath got left %v (called %v)", voluntary, left, ok)
+		}
+		if alive := b.Alive(); len(alive) != 1 || alive[0] != "b" {
+			t.Errorf("voluntary %v: b still knows %v", voluntary, alive)
+		}
+	}
+}
+
+func TestLeftIsNotRefutedAsDeath(t *testing.T) {
+	n := newNetwork()
+	a := n.add("a")
+	b := n.add("b")
+	a.Join("b", n.now)
+	n.tick(a, 0.5, "b")
+
+	d := watch(b)
+	a.Leave(at(1), true)
+	d.wait(t)
+
+	// A death rumour doesn't turn a leave into a kill
+	b.HandlePing(Message{From: "c", Updates: []Update{{"a", Dead, a.incarnation}}}, at(2))
+	select {
+	case <-d.done:
+		t.Errorf("OnDeath called again for a member that left")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if state := b.Members()["a"]; state != Left {
+		t.Errorf("a is %s, want left", state)
+	}
+}
+
+func TestEncodeLeft(t *testing.T) {
+	var buf bytes.Buffer
+	m := Message{From: "a", Updates: []Update{{"a", Left, 7}}}
+	if err := m.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "from a\nleft a 7\n" {
+		t.Errorf("encoded %q", got)
+	}
+	decoded, err := DecodeMessage(&buf)
+	if err != nil || len(decoded.Updates) != 1 || decoded.Updates[0] != m.Updates[0] {
+		t.Errorf("decoded %+v, %v", decoded, err)
+	}
+}
+
+// joined starts a list on each host, all knowing each other
+func joined(t *testing.T, hosts ...string) (*network, []*List) {
+	n := newNetwork()
+	var lists []*List
+	for _, host := range hosts {
+		lists = append(lists, n.add(host))
+	}
+	for _, l := range lists {
+		for _, host := range hosts {
+			if host != l.self {
+				l.Join(host, n.now)
+			}
+		}
+		n.tick(l, 0.1)
+	}
+	for _, l := range lists {
+		if alive := l.Alive(); len(alive) != len(hosts) {
+			t.Fatalf("%s knows %v after joining", l.self, alive)
+		}
+	}
+	return n, lists
+}
+
+func TestSuspectThenDead(t *testing.T) {
+	n, lists := joined(t, "a", "b")
+	a := lists[0]
+	d := watch(a)
+
+	n.setDown("b", true)
+	n.tick(a, 1)
+	if state := a.Members()["b"]; state != Suspect {
+		t.Fatalf("b is %s after a missed ping, want suspect", state)
+	}
+	// Suspects still count as alive
+	if alive := a.Alive(); len(alive) != 2 {
+		t.Errorf("alive %v, want b among them", alive)
+	}
+
+	timeout := DefaultConfig.SuspectTimeout.Seconds()
+	n.tick(a, 1+timeout)
+	if state := a.Members()["b"]; state != Suspect {
+		t.Errorf("b is %s after exactly the suspect timeout, want suspect", state)
+	}
+	n.tick(a, 1+timeout+0.1)
+	if state := a.Members()["b"]; state != Dead {
+		t.Fatalf("b is %s after the suspect timeout, want dead", state)
+	}
+	d.wait(t)
+	if left, ok := d.seen["b"]; !ok || left {
+		t.Errorf("OnDeath got left %v (called %v), want a death", left, ok)
+	}
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	n, lists := joined(t, "a", "b")
+	a, b := lists[0], lists[1]
+	incarnation := b.incarnation
+
+	n.setDown("b", true)
+	n.tick(a, 1)
+	if state := a.Members()["b"]; state != Suspect {
+		t.Fatalf("b is %s after a missed ping, want suspect", state)
+	}
+
+	// b hears of the suspicion with the next ping, and refutes it with a
+	// higher incarnation
+	n.setDown("b", false)
+	n.tick(a, 1.5)
+	if b.incarnation <= incarnation {
+		t.Errorf("b still at incarnation %d after being suspected", b.incarnation)
+	}
+	if state := a.Members()["b"]; state != Alive {
+		t.Fatalf("b is %s after refuting, want alive", state)
+	}
+	n.tick(a, 10)
+	if state := a.Members()["b"]; state != Alive {
+		t.Errorf("b is %s long after refuting, want alive", state)
+	}
+
+	// Old news of the suspicion doesn't bring it back
+	a.HandlePing(Message{From: "c", Updates: []Update{{"b", Suspect, incarnation}}}, at(11))
+	if state := a.Members()["b"]; state != Alive {
+		t.Errorf("b is %s after a stale suspicion, want alive", state)
+	}
+}
+
+func TestPingReq(t *testing.T) {
+	n, lists := joined(t, "a", "b", "c")
+	a := lists[0]
+
+	// a can't reach b, but c can, and vouches for it
+	n.cut("a", "b")
+	for round := 1; round <= 4; round++ {
+		n.tick(a, float64(round))
+	}
+	if state := a.Members()["b"]; state != Alive {
+		t.Fatalf("b is %s, though c reaches it", state)
+	}
+
+	// Once c can't reach it either, b is suspected
+	n.cut("c", "b")
+	for round := 0; round < 4; round++ {
+		n.tick(a, 5+float64(round)*0.5)
+	}
+	if state := a.Members()["b"]; state != Suspect {
+		t.Errorf("b is %s, though nobody reaches it", state)
+	}
+}
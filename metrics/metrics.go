@@ -0,0 +1,270 @@
+// Package metrics keeps counters, gauges and histograms and serves them on
+// /metrics in the Prometheus text exposition format.
+//
+// Metrics register themselves when they are created, so the usual way to
+// declare them is as package variables:
+//
+//	var launched = metrics.NewCounter("wormgate_segments_launched_total",
+//		"Segments started by the worm gate.")
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var registry struct {
+	sync.Mutex
+	metrics []metric
+}
+
+func register(m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, known := range registry.metrics {
+		if known.name() == m.name() {
+			panic("metrics: " + m.name() + " registered twice")
+		}
+	}
+	registry.metrics = append(registry.metrics, m)
+}
+
+func header(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.Replace(help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a count that only goes up.
+type Counter struct {
+	n, help string
+	v       uint64
+}
+
+// NewCounter creates and registers a counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{n: name, help: help}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value returns the count.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) name() string { return c.n }
+
+func (c *Counter) write(w io.Writer) {
+	header(w, c.n, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.n, c.Value())
+}
+
+// CounterVec is a set of counters told apart by the value of one label.
+type CounterVec struct {
+	n, help, label string
+
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec creates and registers a set of counters.
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{n: name, help: help, label: label,
+		counters: make(map[string]*Counter)}
+	register(c)
+	return c
+}
+
+// With returns the counter for a label value.
+func (c *CounterVec) With(value string) *Counter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counter, ok := c.counters[value]
+	if !ok {
+		counter = &Counter{n: c.n}
+		c.counters[value] = counter
+	}
+	return counter
+}
+
+func (c *CounterVec) name() string { return c.n }
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var values []string
+	for value := range c.counters {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	header(w, c.n, c.help, "counter")
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.n, c.label, value, c.counters[value].Value())
+	}
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	n, help string
+	bits    uint64
+}
+
+// NewGauge creates and registers a gauge.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{n: name, help: help}
+	register(g)
+	return g
+}
+
+// Set sets the gauge.
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Value returns the gauge.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) name() string { return g.n }
+
+func (g *Gauge) write(w io.Writer) {
+	header(w, g.n, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.n, formatFloat(g.Value()))
+}
+
+// GaugeFunc is a gauge that asks for its value when scraped.
+type GaugeFunc struct {
+	n, help string
+	f       func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge that calls f for its value.
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{n: name, help: help, f: f}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string { return g.n }
+
+func (g *GaugeFunc) write(w io.Writer) {
+	header(w, g.n, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.n, formatFloat(g.f()))
+}
+
+// Histogram counts observations in buckets, and keeps their count and sum.
+type Histogram struct {
+	n, help string
+	bounds  []float64
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a histogram with buckets for the given
+// upper bounds, in increasing order.
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{n: name, help: help, bounds: bounds,
+		counts: make([]uint64, len(bounds)+1)}
+	register(h)
+	return h
+}
+
+// Observe adds an observation.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) name() string { return h.n }
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	header(w, h.n, h.help, "histogram")
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.n, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.n, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.n, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.n, h.count)
+}
+
+// Handler serves all registered metrics, sorted by name.
+func Handler(w http.ResponseWriter, r *http.Request) {
+
+	// We don't use the request body. But we should consume it anyway.
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+
+	registry.Lock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.Unlock()
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name() < metrics[j].name()
+	})
+
+	buf := new(bytes.Buffer)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.Copy(w, buf)
+}
+
+// CountingReader counts the bytes read through it in a counter.
+type CountingReader struct {
+	R       io.Reader
+	Counter *Counter
+}
+
+func (c CountingReader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.Counter.Add(uint64(n))
+	return n, err
+}
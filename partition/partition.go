@@ -0,0 +1,404 @@
+// Package partition describes the simulated network partitions of the worm
+// gates: for every host, which other hosts it can reach.
+//
+// Two schemes are built in: 0 "none" (everybody reaches everybody) and
+// 1 "racks" (hosts only reach hosts in the same compute-x rack). More can be
+// loaded from a JSON config file:
+//
+//	{"schemes": [
+//	  {"name": "halves", "number": 2,
+//	   "groups": {"left": ["compute-1-*", "compute-2-*"], "right": ["compute-3-*"]},
+//	   "reach": {"left": ["right"]}},
+//	  {"name": "chain",
+//	   "links": [["compute-1-0", "compute-1-1"], ["compute-1-1", "compute-1-2"]],
+//	   "directed": true},
+//	  {"name": "split3", "random": {"k": 3, "seed": 42}}
+//	]}
+//
+// A groups scheme lets hosts reach the other hosts in their groups, plus the
+// groups listed for their group in reach, which may be one-way. Hosts in no
+// group only reach themselves. A links scheme lets hosts reach the hosts they
+// are linked to, both ways unless directed is set. A random scheme splits
+// the hosts into k groups, the same way on every worm gate for the same seed.
+// Host lists may use shell patterns. Schemes without a number are numbered
+// after the ones before them.
+//
+// Any scheme may also degrade links that are not cut, with faults:
+//
+//	{"name": "flaky", "groups": {"all": ["*"]},
+//	 "faults": [
+//	   {"from": "compute-1-*", "to": "compute-3-*",
+//	    "latency": "200ms", "jitter": "50ms", "loss": 0.1, "bandwidth": 65536},
+//	   {"from": "*", "to": "*", "latency": "5ms"}
+//	 ]}
+//
+// A fault applies to the links from hosts matching from to hosts matching
+// to, and back, unless directed is set. The first fault that matches a link
+// decides its profile: the latency each way, give or take up to jitter, the
+// probability that a request is lost, and the bandwidth in bytes per second
+// each way. Links within a host are never degraded.
+package partition
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheme is one partition scheme.
+type Scheme struct {
+	Number int    `json:"number"`
+	Name   string `json:"name"`
+
+	Groups map[string][]string `json:"groups,omitempty"`
+	Reach  map[string][]string `json:"reach,omitempty"`
+
+	Links    [][2]string `json:"links,omitempty"`
+	Directed bool        `json:"directed,omitempty"`
+
+	Random *struct {
+		K    int   `json:"k"`
+		Seed int64 `json:"seed"`
+	} `json:"random,omitempty"`
+
+	Faults []Fault `json:"faults,omitempty"`
+
+	builtin func(from, to string) bool
+
+	// The groups of a random scheme, as dealt for the host list in hosts
+	dealt struct {
+		sync.Mutex
+		hosts  []string
+		groups map[string]int
+	}
+}
+
+// Fault degrades the links between two sets of hosts.
+type Fault struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Directed bool   `json:"directed,omitempty"`
+	Profile
+}
+
+// Profile describes how a link behaves. The zero Profile is a perfect link.
+type Profile struct {
+	Latency Duration `json:"latency,omitempty"`
+	Jitter  Duration `json:"jitter,omitempty"`
+	// Probability that a request is lost, from 0 to 1
+	Loss float64 `json:"loss,omitempty"`
+	// Bytes per second, 0 for no limit
+	Bandwidth int64 `json:"bandwidth,omitempty"`
+}
+
+// Perfect reports whether the link is not degraded at all.
+func (p Profile) Perfect() bool {
+	return p == Profile{}
+}
+
+// Duration is a time.Duration written as a string in JSON, like "150ms".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"150ms\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (s *Scheme) String() string {
+	return fmt.Sprintf("%d %s", s.Number, s.Name)
+}
+
+// Reachable returns the hosts among all that from can reach. A host can
+// always reach itself.
+func (s *Scheme) Reachable(from string, all []string) []string {
+	var groups map[string]int
+	if s.Random != nil {
+		groups = s.randomGroups(all)
+	}
+	var reachable []string
+	for _, to := range all {
+		if sameHost(from, to) || s.reaches(from, to, groups) {
+			reachable = append(reachable, to)
+		}
+	}
+	return reachable
+}
+
+// reaches tells whether from reaches to. groups are the random groups of the
+// hosts, for a random scheme.
+func (s *Scheme) reaches(from, to string, groups map[string]int) bool {
+	switch {
+	case s.builtin != nil:
+		return s.builtin(from, to)
+	case s.Groups != nil:
+		fromGroups := groupsOf(s.Groups, from)
+		toGroups := groupsOf(s.Groups, to)
+		for _, fg := range fromGroups {
+			for _, tg := range toGroups {
+				if fg == tg || contains(s.Reach[fg], tg) {
+					return true
+				}
+			}
+		}
+		return false
+	case s.Links != nil:
+		for _, link := range s.Links {
+			if match(link[0], from) && match(link[1], to) {
+				return true
+			}
+			if !s.Directed && match(link[1], from) && match(link[0], to) {
+				return true
+			}
+		}
+		return false
+	case s.Random != nil:
+		fg, ok := groups[strings.TrimSuffix(from, ".local")]
+		tg, ok2 := groups[strings.TrimSuffix(to, ".local")]
+		return ok && ok2 && fg == tg
+	}
+	return false
+}
+
+// Profile returns how the link from one host to another behaves.
+func (s *Scheme) Profile(from, to string) Profile {
+	if sameHost(from, to) {
+		return Profile{}
+	}
+	for _, f := range s.Faults {
+		if match(f.From, from) && match(f.To, to) {
+			return f.Profile
+		}
+		if !f.Directed && match(f.To, from) && match(f.From, to) {
+			return f.Profile
+		}
+	}
+	return Profile{}
+}
+
+// randomGroups deals the sorted hosts into k groups in a seeded random order,
+// and returns the group of each host. The groups are dealt again only when the
+// hosts change.
+func (s *Scheme) randomGroups(all []string) map[string]int {
+	s.dealt.Lock()
+	defer s.dealt.Unlock()
+	if s.dealt.groups != nil && equal(s.dealt.hosts, all) {
+		return s.dealt.groups
+	}
+
+	sorted := append([]string(nil), all...)
+	sort.Strings(sorted)
+	rng := rand.New(rand.NewSource(s.Random.Seed))
+	order := rng.Perm(len(sorted))
+	groups := make(map[string]int, len(sorted))
+	for i, j := range order {
+		host := strings.TrimSuffix(sorted[j], ".local")
+		if _, ok := groups[host]; !ok {
+			groups[host] = i % s.Random.K
+		}
+	}
+	s.dealt.hosts = append([]string(nil), all...)
+	s.dealt.groups = groups
+	return groups
+}
+
+// sameHost compares host names, ignoring a .local suffix
+func sameHost(a, b string) bool {
+	return strings.TrimSuffix(a, ".local") == strings.TrimSuffix(b, ".local")
+}
+
+func match(pattern, host string) bool {
+	ok, err := path.Match(pattern, strings.TrimSuffix(host, ".local"))
+	return err == nil && ok
+}
+
+func groupsOf(groups map[string][]string, host string) []string {
+	var names []string
+	for name, patterns := range groups {
+		for _, pattern := range patterns {
+			if match(pattern, host) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Set is the collection of schemes a worm gate can switch between.
+type Set struct {
+	schemes []*Scheme
+}
+
+// Builtin returns the set of built-in schemes.
+func Builtin() *Set {
+	return &Set{[]*Scheme{
+		{Number: 0, Name: "none", builtin: func(from, to string) bool {
+			return true
+		}},
+		{Number: 1, Name: "racks", builtin: func(from, to string) bool {
+			n := len("compute-x")
+			return len(from) >= n && len(to) >= n && from[0:n] == to[0:n]
+		}},
+	}}
+}
+
+// Load reads schemes from a config file and adds them to the built-in ones.
+func Load(fn string) (*Set, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Kept raw at first, to tell the schemes without a number from the
+	// ones numbered 0
+	var config struct {
+		Schemes []json.RawMessage `json:"schemes"`
+	}
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+
+	set := Builtin()
+	next := len(set.schemes)
+	for _, raw := range config.Schemes {
+		s := new(Scheme)
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, s); err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		json.Unmarshal(raw, &fields)
+		if err := s.check(); err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		if _, numbered := fields["number"]; !numbered {
+			s.Number = next
+		}
+		next = s.Number + 1
+		if err := set.add(s); err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+	}
+	return set, nil
+}
+
+func (s *Scheme) check() error {
+	if s.Name == "" {
+		return fmt.Errorf("scheme %d has no name", s.Number)
+	}
+	if _, err := strconv.Atoi(s.Name); err == nil {
+		return fmt.Errorf("scheme name %q is a number", s.Name)
+	}
+	kinds := 0
+	if s.Groups != nil {
+		kinds++
+	}
+	if s.Links != nil {
+		kinds++
+	}
+	if s.Random != nil {
+		kinds++
+		if s.Random.K < 1 {
+			return fmt.Errorf("scheme %q: random needs k of at least 1", s.Name)
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("scheme %q needs exactly one of groups, links or random", s.Name)
+	}
+	for group := range s.Reach {
+		if _, ok := s.Groups[group]; !ok {
+			return fmt.Errorf("scheme %q: reach from unknown group %q", s.Name, group)
+		}
+	}
+	for i, f := range s.Faults {
+		if err := f.check(); err != nil {
+			return fmt.Errorf("scheme %q: fault %d: %s", s.Name, i+1, err)
+		}
+	}
+	return nil
+}
+
+func (f Fault) check() error {
+	for _, pattern := range []string{f.From, f.To} {
+		if pattern == "" {
+			return fmt.Errorf("needs from and to")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q", pattern)
+		}
+	}
+	if f.Latency < 0 || f.Jitter < 0 || f.Bandwidth < 0 {
+		return fmt.Errorf("latency, jitter and bandwidth can't be negative")
+	}
+	if f.Loss < 0 || f.Loss > 1 {
+		return fmt.Errorf("loss should be between 0 and 1")
+	}
+	return nil
+}
+
+func (set *Set) add(s *Scheme) error {
+	for _, known := range set.schemes {
+		if known.Number == s.Number || known.Name == s.Name {
+			return fmt.Errorf("scheme %q clashes with %q", s, known)
+		}
+	}
+	set.schemes = append(set.schemes, s)
+	return nil
+}
+
+// Lookup finds a scheme by number or by name.
+func (set *Set) Lookup(key string) (*Scheme, error) {
+	key = strings.TrimSpace(key)
+	number, err := strconv.Atoi(key)
+	for _, s := range set.schemes {
+		if (err == nil && s.Number == number) || s.Name == key {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown partition scheme %q", key)
+}
+
+// Schemes returns all schemes, in the order they were added.
+func (set *Set) Schemes() []*Scheme {
+	return set.schemes
+}
@@ -0,0 +1,185 @@
+package partition
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var hosts = []string{
+	"compute-1-0", "compute-1-1", "compute-2-0", "compute-2-1", "compute-3-0", "compute-3-1",
+}
+
+// load writes config to a file and loads it
+func load(t *testing.T, config string) (*Set, error) {
+	dir, err := ioutil.TempDir("", "partition")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "partitions.json")
+	if err := ioutil.WriteFile(fn, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(fn)
+}
+
+func scheme(t *testing.T, config string) *Scheme {
+	set, err := load(t, `{"schemes": [`+config+`]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemes := set.Schemes()
+	return schemes[len(schemes)-1]
+}
+
+func TestReachable(t *testing.T) {
+	tests := []struct {
+		scheme string
+		from   string
+		want   []string
+	}{
+		{`{"name": "racks2", "groups": {"r1": ["compute-1-*"], "r2": ["compute-2-*"]}}`,
+			"compute-1-0", []string{"compute-1-0", "compute-1-1"}},
+		// Hosts in no group only reach themselves
+		{`{"name": "racks2", "groups": {"r1": ["compute-1-*"], "r2": ["compute-2-*"]}}`,
+			"compute-3-0", []string{"compute-3-0"}},
+		// Reach is one-way
+		{`{"name": "oneway", "groups": {"a": ["compute-1-*"], "b": ["compute-2-*"]}, "reach": {"a": ["b"]}}`,
+			"compute-1-0", []string{"compute-1-0", "compute-1-1", "compute-2-0", "compute-2-1"}},
+		{`{"name": "oneway", "groups": {"a": ["compute-1-*"], "b": ["compute-2-*"]}, "reach": {"a": ["b"]}}`,
+			"compute-2-0", []string{"compute-2-0", "compute-2-1"}},
+		// A host in two groups reaches both
+		{`{"name": "overlap", "groups": {"a": ["compute-1-0", "compute-2-0"], "b": ["compute-2-0", "compute-3-0"]}}`,
+			"compute-2-0", []string{"compute-2-0", "compute-1-0", "compute-3-0"}},
+		{`{"name": "chain", "links": [["compute-1-0", "compute-1-1"], ["compute-1-1", "compute-2-0"]]}`,
+			"compute-1-1", []string{"compute-1-0", "compute-1-1", "compute-2-0"}},
+		{`{"name": "chain", "links": [["compute-1-0", "compute-1-1"], ["compute-1-1", "compute-2-0"]], "directed": true}`,
+			"compute-1-1", []string{"compute-1-1", "compute-2-0"}},
+		{`{"name": "chain", "links": [["compute-1-0", "compute-1-1"], ["compute-1-1", "compute-2-0"]], "directed": true}`,
+			"compute-2-0", []string{"compute-2-0"}},
+		{`{"name": "star", "links": [["compute-1-0", "*"]]}`,
+			"compute-3-1", []string{"compute-1-0", "compute-3-1"}},
+		// A .local suffix doesn't matter
+		{`{"name": "racks2", "groups": {"r1": ["compute-1-*"]}}`,
+			"compute-1-1.local", []string{"compute-1-0", "compute-1-1"}},
+	}
+	for _, test := range tests {
+		got := scheme(t, test.scheme).Reachable(test.from, hosts)
+		if !sameSet(got, test.want) {
+			t.Errorf("%s from %s: reachable %v, want %v", test.scheme, test.from, got, test.want)
+		}
+	}
+}
+
+func TestRandom(t *testing.T) {
+	config := `{"name": "split3", "random": {"k": 3, "seed": 42}}`
+	a, b := scheme(t, config), scheme(t, config)
+
+	// Every host is in exactly one of the k groups, the same ones on every
+	// worm gate, whatever order the worm gate lists the hosts in
+	shuffled := []string{"compute-3-1", "compute-1-0", "compute-2-1", "compute-1-1", "compute-3-0", "compute-2-0"}
+	groups := map[string]bool{}
+	for _, host := range hosts {
+		reachable := a.Reachable(host, hosts)
+		other := b.Reachable(host, shuffled)
+		if !sameSet(reachable, other) {
+			t.Errorf("%s reaches %v on one worm gate and %v on another", host, reachable, other)
+		}
+		for _, to := range reachable {
+			if back := a.Reachable(to, hosts); !sameSet(back, reachable) {
+				t.Errorf("%s reaches %v, but %s reaches %v", host, reachable, to, back)
+			}
+		}
+		groups[strings.Join(sorted(reachable), " ")] = true
+	}
+	if len(groups) != 3 {
+		t.Errorf("%d groups, want 3: %v", len(groups), groups)
+	}
+
+	// Asking again gives the same answer, and a new host list deals anew
+	first := a.Reachable("compute-1-0", hosts)
+	if again := a.Reachable("compute-1-0", hosts); !sameSet(first, again) {
+		t.Errorf("reachable changed from %v to %v", first, again)
+	}
+	fewer := hosts[:3]
+	if got := a.Reachable("compute-1-0", fewer); !sameSet(got, b.Reachable("compute-1-0", fewer)) {
+		t.Errorf("groups for a shorter host list differ: %v", got)
+	}
+
+	// Other seeds split differently
+	c := scheme(t, `{"name": "split3", "random": {"k": 3, "seed": 7}}`)
+	differ := false
+	for _, host := range hosts {
+		if !sameSet(a.Reachable(host, hosts), c.Reachable(host, hosts)) {
+			differ = true
+		}
+	}
+	if !differ {
+		t.Errorf("seeds 42 and 7 split the hosts the same way")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	s := scheme(t, `{"name": "flaky", "groups": {"all": ["*"]}, "faults": [
+		{"from": "compute-1-*", "to": "compute-3-*", "latency": "200ms", "loss": 0.1},
+		{"from": "compute-2-0", "to": "compute-2-1", "directed": true, "bandwidth": 1024},
+		{"from": "*", "to": "*", "latency": "5ms"}
+	]}`)
+	slow := Profile{Latency: Duration(200 * time.Millisecond), Loss: 0.1}
+	narrow := Profile{Bandwidth: 1024}
+	rest := Profile{Latency: Duration(5 * time.Millisecond)}
+	tests := []struct {
+		from, to string
+		want     Profile
+	}{
+		{"compute-1-0", "compute-3-1", slow},
+		{"compute-3-1", "compute-1-0", slow},
+		{"compute-2-0", "compute-2-1", narrow},
+		{"compute-2-1", "compute-2-0", rest},
+		{"compute-1-0", "compute-1-1", rest},
+		{"compute-1-0", "compute-1-0.local", Profile{}},
+	}
+	for _, test := range tests {
+		if got := s.Profile(test.from, test.to); got != test.want {
+			t.Errorf("%s to %s: %+v, want %+v", test.from, test.to, got, test.want)
+		}
+	}
+}
+
+func TestLoadNumbers(t *testing.T) {
+	set, err := load(t, `{"schemes": [
+		{"name": "a", "groups": {"all": ["*"]}},
+		{"name": "b", "number": 7, "groups": {"all": ["*"]}},
+		{"name": "c", "groups": {"all": ["*"]}}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]int{"a": 2, "b": 7, "c": 8, "none": 0, "racks": 1} {
+		s, err := set.Lookup(key)
+		if err != nil || s.Number != want {
+			t.Errorf("scheme %s: %v %v, want number %d", key, s, err, want)
+		}
+	}
+
+	// An explicit 0 is taken at its word, and clashes with "none"
+	if _, err := load(t, `{"schemes": [{"name": "zero", "number": 0, "groups": {}}]}`); err == nil {
+		t.Errorf("scheme numbered 0 loaded")
+	}
+}
+
+func sorted(hosts []string) []string {
+	s := append([]string(nil), hosts...)
+	sort.Strings(s)
+	return s
+}
+
+func sameSet(a, b []string) bool {
+	return reflect.DeepEqual(sorted(a), sorted(b))
+}
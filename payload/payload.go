@@ -0,0 +1,325 @@
+// Package payload packs and unpacks the tar.gz archives that carry worm
+// segments to the worm gates.
+//
+// An archive contains the segment binary at the top level, and optionally
+// extra files (configuration, state snapshots) under the payload directory.
+// A signed archive also carries a manifest and its signature at the top
+// level. Nothing else is accepted when extracting.
+package payload
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Binary is the name of the segment executable in the archive.
+const Binary = "segment"
+
+// Dir is the directory in the archive that holds extra files.
+const Dir = "payload"
+
+// File is an extra file to ship with the segment. Its content is read from
+// Path on disk if set, otherwise it is Data.
+type File struct {
+	Name string // relative to Dir
+	Path string
+	Data []byte
+	Mode int64 // 0644 if zero
+}
+
+// RejectError tells why an archive was refused.
+type RejectError struct {
+	Name   string
+	Reason string
+	// OverBudget is set if the archive unpacks to more than it may.
+	OverBudget bool
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("rejected archive entry %q: %s", e.Name, e.Reason)
+}
+
+func reject(name, format string, args ...interface{}) error {
+	return &RejectError{Name: name, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Write streams an archive holding the binary at binaryPath and the extra
+// files to w. If key is not nil, the archive is signed with it: the files are
+// hashed first, so that the signed manifest can lead the archive.
+func Write(w io.Writer, binaryPath string, extra []File, key ed25519.PrivateKey) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	var err error
+	if key != nil {
+		var m manifest
+		m, err = hashFiles(binaryPath, extra)
+		if err == nil {
+			err = writeSignature(tw, m, key)
+		}
+	}
+	if err == nil {
+		err = writeFile(tw, Binary, binaryPath, nil, 0755)
+	}
+	for _, f := range extra {
+		if err != nil {
+			break
+		}
+		mode := f.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+		err = writeFile(tw, path.Join(Dir, f.Name), f.Path, f.Data, mode)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	return err
+}
+
+func writeFile(tw *tar.Writer, name, diskPath string, data []byte, mode int64) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     mode,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	}
+
+	if diskPath == "" {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	file, err := os.Open(diskPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	hdr.Size = info.Size()
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// hashFiles builds the manifest of the files Write puts in an archive
+func hashFiles(binaryPath string, extra []File) (manifest, error) {
+	m := newManifest()
+	files := append([]File{{Path: binaryPath}}, extra...)
+	for i, f := range files {
+		name := Binary
+		if i > 0 {
+			name = path.Join(Dir, f.Name)
+		}
+		hash := sha256.New()
+		if f.Path == "" {
+			hash.Write(f.Data)
+		} else {
+			file, err := os.Open(f.Path)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(hash, file)
+			file.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		m[name] = fmt.Sprintf("%x", hash.Sum(nil))
+	}
+	return m, nil
+}
+
+// Extract unpacks an archive into dir, which must exist. It refuses entries
+// that would end up outside dir, symlinks, and anything other than the binary
+// and the contents of the payload directory.
+//
+// If pub is not nil, the archive must be signed with the matching private
+// key. The signed manifest comes first in the archive, and is checked before
+// anything is written to dir. After that, only entries listed in the manifest
+// are extracted, and each must match its digest. Otherwise a *VerifyError is
+// returned. An entry that doesn't match its digest is removed again, but the
+// entries before it are left, the caller must not use them on error.
+//
+// If budget is not 0, the files may add up to no more than budget bytes. An
+// entry that would go over it is refused before it is written.
+func Extract(r io.Reader, dir string, pub ed25519.PublicKey, budget int64) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return reject("", "not gzip: %s", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	foundBinary := false
+	var unpacked int64
+	extracted := newManifest()
+	var signed manifest // once the signature checks out
+	var manifestData, signature []byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return reject("", "bad tar stream: %s", err)
+		}
+
+		name, err := checkName(hdr)
+		if err != nil {
+			return err
+		}
+		if name == ManifestName || name == SignatureName {
+			if hdr.Typeflag != tar.TypeReg || hdr.Size > maxManifestSize {
+				return reject(hdr.Name, "bad manifest entry")
+			}
+			if signed != nil {
+				return reject(hdr.Name, "duplicate entry")
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return reject(hdr.Name, "bad tar stream: %s", err)
+			}
+			if name == ManifestName {
+				manifestData = data
+			} else {
+				signature = data
+			}
+			if pub != nil && manifestData != nil && signature != nil {
+				signed, err = verify(pub, manifestData, signature)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		want := ""
+		if pub != nil {
+			if signed == nil {
+				return &VerifyError{fmt.Sprintf("%q comes before the signed manifest", hdr.Name)}
+			}
+			var listed bool
+			want, listed = signed[name]
+			if !listed || hdr.Typeflag != tar.TypeReg {
+				return &VerifyError{fmt.Sprintf("%q is not in the manifest", hdr.Name)}
+			}
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if name == Binary {
+				return reject(hdr.Name, "binary must be a regular file")
+			}
+			err = os.MkdirAll(dest, 0700)
+		case tar.TypeReg:
+			if name == Binary {
+				foundBinary = true
+			}
+			unpacked += hdr.Size
+			if budget > 0 && unpacked > budget {
+				return &RejectError{hdr.Name,
+					fmt.Sprintf("archive unpacks to more than %d bytes", budget), true}
+			}
+			var digest string
+			digest, err = extractFile(tr, dest, hdr)
+			if err == nil && want != "" && digest != want {
+				os.Remove(dest)
+				err = &VerifyError{fmt.Sprintf("%q does not match the manifest", hdr.Name)}
+			}
+			extracted[name] = digest
+		case tar.TypeSymlink, tar.TypeLink:
+			// Later entries could be written through them
+			return reject(hdr.Name, "links are not allowed")
+		default:
+			return reject(hdr.Name, "unsupported entry type %q", hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if pub != nil {
+		if signed == nil {
+			return &VerifyError{"archive is not signed"}
+		}
+		for name := range signed {
+			if _, ok := extracted[name]; !ok {
+				return &VerifyError{fmt.Sprintf("%q is missing from the archive", name)}
+			}
+		}
+	}
+	if !foundBinary {
+		return reject(Binary, "missing from archive")
+	}
+	return nil
+}
+
+// checkName returns the cleaned entry name, or an error if the entry is not
+// one we expect.
+func checkName(hdr *tar.Header) (string, error) {
+	if path.IsAbs(hdr.Name) || strings.Contains(hdr.Name, "\\") {
+		return "", reject(hdr.Name, "absolute path")
+	}
+	name := path.Clean(hdr.Name)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", reject(hdr.Name, "path outside extraction directory")
+	}
+	if name != Binary && name != ManifestName && name != SignatureName &&
+		name != Dir && !strings.HasPrefix(name, Dir+"/") {
+		return "", reject(hdr.Name, "unexpected entry")
+	}
+	return name, nil
+}
+
+// extractFile writes an entry to dest, and returns the hex SHA-256 of what
+// it wrote.
+func extractFile(r io.Reader, dest string, hdr *tar.Header) (string, error) {
+	err := os.MkdirAll(filepath.Dir(dest), 0700)
+	if err != nil {
+		return "", err
+	}
+
+	// O_EXCL, so we never write through a symlink or over an earlier entry
+	mode := os.FileMode(hdr.Mode).Perm() &^ 022
+	file, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if os.IsExist(err) {
+		return "", reject(hdr.Name, "duplicate entry")
+	}
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), err
+}
@@ -0,0 +1,209 @@
+package payload
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// entry is a tar entry for building test archives
+type entry struct {
+	name     string
+	typeflag byte
+	data     string
+	linkname string
+}
+
+func archive(t *testing.T, entries []entry) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     0755,
+			Size:     int64(len(e.data)),
+			Linkname: e.linkname,
+		})
+		if err == nil {
+			_, err = tw.Write([]byte(e.data))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestExtractSymlinkEscape(t *testing.T) {
+	root, err := ioutil.TempDir("", "payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "a", "b", "extract")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each link stays inside the extraction directory by itself, but the
+	// last one resolves to two levels above it
+	body := archive(t, []entry{
+		{name: Binary, typeflag: tar.TypeReg, data: "#!/bin/sh\n"},
+		{name: "payload/a/", typeflag: tar.TypeDir},
+		{name: "payload/a/b", typeflag: tar.TypeSymlink, linkname: "../.."},
+		{name: "payload/a/b/c", typeflag: tar.TypeSymlink, linkname: "../.."},
+		{name: "payload/a/b/c/escaped.txt", typeflag: tar.TypeReg, data: "escaped\n"},
+	})
+	err = Extract(body, dir, nil, 0)
+	if _, ok := err.(*RejectError); !ok {
+		t.Errorf("got %v, want a RejectError", err)
+	}
+
+	filepath.Walk(root, func(fn string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == "escaped.txt" {
+			t.Errorf("%s was written", fn)
+		}
+		return nil
+	})
+}
+
+func TestExtract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	body := new(bytes.Buffer)
+	extra := []File{{Name: "state", Data: []byte("targetsegments 3\n")}}
+	if err := Write(body, "payload_test.go", extra, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Extract(body, dir, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, Dir, "state"))
+	if err != nil || string(data) != "targetsegments 3\n" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, Binary)); err != nil {
+		t.Error(err)
+	}
+}
+
+// signedEntries returns the manifest entries signing files with key
+func signedEntries(key ed25519.PrivateKey, files map[string]string) []entry {
+	m := newManifest()
+	for name, data := range files {
+		m[name] = fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, m.Bytes()))
+	return []entry{
+		{name: ManifestName, typeflag: tar.TypeReg, data: string(m.Bytes())},
+		{name: SignatureName, typeflag: tar.TypeReg, data: signature + "\n"},
+	}
+}
+
+func TestExtractSigned(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := "#!/bin/sh\n"
+	signed := signedEntries(key, map[string]string{Binary: binary})
+
+	for _, c := range []struct {
+		name    string
+		entries []entry
+		ok      bool
+		absent  string // must not be on disk afterwards
+	}{
+		{"signed", append(signed, entry{name: Binary, typeflag: tar.TypeReg, data: binary}), true, ""},
+		{"unsigned", []entry{{name: Binary, typeflag: tar.TypeReg, data: binary}}, false, Binary},
+		{"manifest last", []entry{{name: Binary, typeflag: tar.TypeReg, data: binary}, signed[0], signed[1]}, false, Binary},
+		{"tampered", append(signed, entry{name: Binary, typeflag: tar.TypeReg, data: "rm -rf ~\n"}), false, Binary},
+		{"not listed", append(signed,
+			entry{name: Binary, typeflag: tar.TypeReg, data: binary},
+			entry{name: "payload/extra", typeflag: tar.TypeReg, data: "extra\n"}), false, "payload"},
+		{"directory", append(signed[:2:2], entry{name: "payload/", typeflag: tar.TypeDir}), false, "payload"},
+		{"missing", signed, false, ""},
+	} {
+		dir, err := ioutil.TempDir("", "payload")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Extract(archive(t, c.entries), dir, pub, 0)
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if _, ok := err.(*VerifyError); !c.ok && !ok {
+			t.Errorf("%s: got %v, want a VerifyError", c.name, err)
+		}
+		if _, err := os.Lstat(filepath.Join(dir, c.absent)); c.absent != "" && err == nil {
+			t.Errorf("%s: %s was written", c.name, c.absent)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestWriteSigned(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	body := new(bytes.Buffer)
+	extra := []File{{Name: "state", Data: []byte("targetsegments 3\n")}}
+	if err := Write(body, "payload_test.go", extra, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := Extract(body, dir, pub, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Compresses to next to nothing
+	big := string(make([]byte, 1<<20))
+	body := archive(t, []entry{
+		{name: Binary, typeflag: tar.TypeReg, data: "#!/bin/sh\n"},
+		{name: "payload/big", typeflag: tar.TypeReg, data: big},
+	})
+	if body.Len() > 1<<14 {
+		t.Fatalf("archive is %d bytes, expected it to compress well", body.Len())
+	}
+	err = Extract(body, dir, nil, 1<<19)
+	if reject, ok := err.(*RejectError); !ok || !reject.OverBudget {
+		t.Errorf("got %v, want a RejectError over budget", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, Dir, "big")); err == nil {
+		t.Error("file over budget was written")
+	}
+}
@@ -0,0 +1,165 @@
+package payload
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of the signature entries in the archive
+const (
+	ManifestName  = "MANIFEST"
+	SignatureName = "MANIFEST.sig"
+)
+
+const maxManifestSize = 1 << 20
+
+// VerifyError tells why the signature of an archive was not accepted.
+type VerifyError struct {
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	return "bad signature: " + e.Reason
+}
+
+// manifest maps entry names to the hex SHA-256 of their content.
+type manifest map[string]string
+
+func newManifest() manifest {
+	return make(manifest)
+}
+
+// Bytes renders the manifest as `<digest>  <name>` lines, sorted by name.
+// This is what gets signed.
+func (m manifest) Bytes() []byte {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	for _, name := range names {
+		fmt.Fprintf(buf, "%s  %s\n", m[name], name)
+	}
+	return buf.Bytes()
+}
+
+func writeSignature(tw *tar.Writer, m manifest, key ed25519.PrivateKey) error {
+	signed := m.Bytes()
+	signature := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, signed)) + "\n")
+
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{{ManifestName, signed}, {SignatureName, signature}} {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     entry.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(entry.data)),
+			ModTime:  time.Now(),
+		})
+		if err == nil {
+			_, err = tw.Write(entry.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks the signature of the manifest, and returns the manifest.
+func verify(pub ed25519.PublicKey, signed, signature []byte) (manifest, error) {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, &VerifyError{"malformed signature"}
+	}
+	if !ed25519.Verify(pub, signed, sig) {
+		return nil, &VerifyError{"signature does not match key"}
+	}
+	m, err := parseManifest(signed)
+	if err != nil {
+		return nil, &VerifyError{err.Error()}
+	}
+	return m, nil
+}
+
+// parseManifest reads the lines written by manifest.Bytes.
+func parseManifest(data []byte) (manifest, error) {
+	m := newManifest()
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 || len(fields[0]) != 2*sha256.Size || fields[1] == "" {
+			return nil, fmt.Errorf("bad manifest line %q", line)
+		}
+		if _, dup := m[fields[1]]; dup {
+			return nil, fmt.Errorf("%q listed twice in manifest", fields[1])
+		}
+		m[fields[1]] = fields[0]
+	}
+	return m, nil
+}
+
+// ParsePublicKey decodes a base64 encoded ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key has %d bytes, expected %d",
+			len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// LoadPublicKey reads a public key file written by GenerateKey.
+func LoadPublicKey(fn string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(string(data))
+}
+
+// LoadPrivateKey reads a private key file written by GenerateKey.
+func LoadPrivateKey(fn string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("private key has %d bytes, expected %d",
+			len(key), ed25519.PrivateKeySize)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// GenerateKey creates a new key pair, and writes the private key to fn and
+// the public key to fn + ".pub", both base64 encoded.
+func GenerateKey(fn string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(fn, []byte(base64.StdEncoding.EncodeToString(priv)+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn+".pub", []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644)
+}
@@ -0,0 +1,255 @@
+// Package proxy is the worm gate's forward proxy for segments. It only lets
+// requests through to nodes that the partition scheme lets the worm gate
+// reach, so that a segment that forgets to check the reachable hosts runs
+// into the partition instead of quietly talking across it.
+//
+// Segments address other nodes by name through the proxy, as in
+// http://compute-1-2:8182/ping, and the proxy resolves the name. Plain HTTP
+// requests with an absolute URL are forwarded, and CONNECT requests are
+// tunneled.
+//
+// Links that are not cut may still be degraded, as the partition scheme's
+// faults say. Requests and responses are held back for the latency, give or
+// take the jitter, and their bodies are sent no faster than the bandwidth.
+// A lost request or response is never answered: the client hears nothing
+// until it gives up. Tunnels get the latency and loss once, when they are
+// opened, and the bandwidth throughout.
+package proxy
+
+import (
+	"../metrics"
+	"../partition"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// How long a lost request is held, if the client doesn't give up first
+const lostTimeout = 30 * time.Second
+
+var errLost = errors.New("response lost")
+
+var requests = metrics.NewCounterVec("wormgate_proxy_requests_total",
+	"Requests through the proxy, by result.", "result")
+
+// Proxy forwards requests to reachable nodes.
+type Proxy struct {
+	// Resolve finds the node a request is for from the host:port in the
+	// request, and the address to reach it at.
+	Resolve func(hostport string) (node, addr string, err error)
+	// Reachable reports whether requests may go to node.
+	Reachable func(node string) bool
+	// Profiles returns how the links to node and back behave. Nil means
+	// perfect links.
+	Profiles func(node string) (out, back partition.Profile)
+
+	forward *httputil.ReverseProxy
+}
+
+// route is where a request goes, and the links it takes
+type route struct {
+	addr      string
+	out, back partition.Profile
+}
+
+// Context key for the route, from ServeHTTP to the ReverseProxy hooks
+type routeKey struct{}
+
+// New creates a proxy.
+func New(resolve func(string) (string, string, error), reachable func(string) bool) *Proxy {
+	p := &Proxy{Resolve: resolve, Reachable: reachable}
+	p.forward = &httputil.ReverseProxy{
+		// The request already says where it goes, Director just
+		// points it at the node's address
+		Director: func(r *http.Request) {
+			rt := r.Context().Value(routeKey{}).(route)
+			r.URL.Scheme = "http"
+			r.URL.Host = rt.addr
+			r.Body = throttle(r.Body, rt.out.Bandwidth)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			rt := resp.Request.Context().Value(routeKey{}).(route)
+			if lose(rt.back) {
+				resp.Body.Close()
+				return errLost
+			}
+			delay(resp.Request.Context(), rt.back)
+			resp.Body = throttle(resp.Body, rt.back.Bandwidth)
+			return nil
+		},
+		// Not http.DefaultTransport, which would pick up a proxy from
+		// the environment
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if err == errLost {
+				drop(w, r)
+				return
+			}
+			requests.With("error").Inc()
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+	return p
+}
+
+// IsProxyRequest reports whether a request is meant for a proxy rather than
+// for the server it was sent to: a CONNECT, or a request for an absolute URL.
+func IsProxyRequest(r *http.Request) bool {
+	return r.Method == http.MethodConnect || r.URL.IsAbs()
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hostport := r.URL.Host
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, "80")
+	}
+
+	node, addr, err := p.Resolve(hostport)
+	if err != nil {
+		requests.With("unknown").Inc()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !p.Reachable(node) {
+		requests.With("unreachable").Inc()
+		http.Error(w, fmt.Sprintf("%s is not reachable", node), http.StatusForbidden)
+		return
+	}
+
+	rt := route{addr: addr}
+	if p.Profiles != nil {
+		rt.out, rt.back = p.Profiles(node)
+	}
+	if lose(rt.out) {
+		drop(w, r)
+		return
+	}
+	delay(r.Context(), rt.out)
+
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r, rt)
+		return
+	}
+	requests.With("forwarded").Inc()
+	p.forward.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, rt)))
+}
+
+// tunnel connects the client to addr and copies bytes both ways until one
+// side is done
+func (p *Proxy) tunnel(w http.ResponseWriter, r *http.Request, rt route) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't tunnel on this connection", http.StatusInternalServerError)
+		return
+	}
+	target, err := net.DialTimeout("tcp", rt.addr, 10*time.Second)
+	if err != nil {
+		requests.With("error").Inc()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		target.Close()
+		log.Printf("Error taking over proxy connection: %s", err)
+		return
+	}
+	requests.With("tunneled").Inc()
+	delay(r.Context(), rt.back)
+	io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// The client may have sent more than the request already
+		io.Copy(target, throttle(io.NopCloser(buffered), rt.out.Bandwidth))
+		closeWrite(target)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, throttle(target, rt.back.Bandwidth))
+		closeWrite(client)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	client.Close()
+	target.Close()
+}
+
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+}
+
+// lose decides whether a message on a link gets lost
+func lose(p partition.Profile) bool {
+	return p.Loss > 0 && rand.Float64() < p.Loss
+}
+
+// delay holds a message back for the latency of the link, give or take the
+// jitter
+func delay(ctx context.Context, p partition.Profile) {
+	d := time.Duration(p.Latency)
+	if p.Jitter > 0 {
+		d += time.Duration((2*rand.Float64() - 1) * float64(p.Jitter))
+	}
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// drop makes a request look lost: it is not answered until the client gives
+// up, and then the connection is closed without a word
+func drop(w http.ResponseWriter, r *http.Request) {
+	requests.With("lost").Inc()
+	select {
+	case <-r.Context().Done():
+	case <-time.After(lostTimeout):
+	}
+	if hijacker, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+}
+
+// throttled reads no faster than bps bytes per second
+type throttled struct {
+	io.ReadCloser
+	bps   int64
+	start time.Time
+	n     int64
+}
+
+func throttle(r io.ReadCloser, bps int64) io.ReadCloser {
+	if bps <= 0 || r == nil {
+		return r
+	}
+	return &throttled{ReadCloser: r, bps: bps, start: time.Now()}
+}
+
+func (t *throttled) Read(p []byte) (int, error) {
+	// Small reads, so that a tenth of a second's worth goes at a time
+	if max := int(t.bps/10) + 1; len(p) > max {
+		p = p[:max]
+	}
+	n, err := t.ReadCloser.Read(p)
+	t.n += int64(n)
+	due := t.start.Add(time.Duration(float64(t.n) / float64(t.bps) * float64(time.Second)))
+	time.Sleep(time.Until(due))
+	return n, err
+}
@@ -0,0 +1,146 @@
+// Package recording saves what the visualizer sees and does to an event log,
+// so that a session can be replayed later.
+//
+// The log has one JSON event per line. It starts with a start event listing
+// the nodes and the initial settings, followed by status events when a node
+// changes, command events when a setting changes, and kill events when the
+// visualizer kills a segment.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event kinds
+const (
+	Start   = "start"
+	Status  = "status"
+	Command = "command"
+	Kill    = "kill"
+)
+
+// Commands, as in command events
+const (
+	TargetSegments  = "target"
+	KillRate        = "killrate"
+	PartitionScheme = "partition"
+	Shutdown        = "shutdown"
+)
+
+// Event is one entry in the log. Which fields are set depends on the kind.
+type Event struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+
+	// Start
+	Nodes []string `json:"nodes,omitempty"`
+
+	// Status and kill
+	Node string `json:"node,omitempty"`
+
+	// Status
+	Wormgate  bool    `json:"wormgate,omitempty"`
+	Segment   bool    `json:"segment,omitempty"`
+	Err       bool    `json:"err,omitempty"`
+	RateGuess float32 `json:"rateGuess,omitempty"`
+	RateOk    bool    `json:"rateOk,omitempty"`
+
+	// Command, and the initial settings in start
+	Command string `json:"command,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Target  int32  `json:"target,omitempty"`
+	Rate    int32  `json:"rate,omitempty"`
+	Scheme  string `json:"scheme,omitempty"`
+}
+
+// Recorder writes events to a log file. A nil Recorder records nothing.
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// Create starts a new log file.
+func Create(fn string) (*Recorder, error) {
+	file, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Record adds an event to the log, stamped with the current time.
+func (r *Recorder) Record(e Event) {
+	if r == nil {
+		return
+	}
+	e.Time = time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.enc == nil {
+		return
+	}
+	if err := r.enc.Encode(e); err != nil {
+		// Don't let a full disk take the visualizer down
+		fmt.Fprintf(os.Stderr, "Error recording event, stopped recording: %s\n", err)
+		r.enc = nil
+	}
+}
+
+// Close closes the log file.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc = nil
+	return r.file.Close()
+}
+
+// Load reads a log file.
+func Load(fn string) ([]Event, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fn, line, err)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(events) == 0 || events[0].Kind != Start {
+		return nil, fmt.Errorf("%s: does not start with a start event", fn)
+	}
+	return events, nil
+}
+
+// Replay calls apply for every event, keeping the time between events as
+// recorded, divided by speed.
+func Replay(events []Event, speed float64, apply func(Event)) {
+	if len(events) == 0 {
+		return
+	}
+	recStart := events[0].Time
+	start := time.Now()
+	for _, e := range events {
+		offset := time.Duration(float64(e.Time.Sub(recStart)) / speed)
+		time.Sleep(time.Until(start.Add(offset)))
+		apply(e)
+	}
+}
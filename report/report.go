@@ -0,0 +1,54 @@
+// Package report defines the status that segments report on GET /status,
+// shared by the segment and the visualizer.
+package report
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Status is what a segment knows about itself and the worm.
+type Status struct {
+	Hostname string    `json:"hostname"`
+	Started  time.Time `json:"started"`
+	// Seconds since the segment started
+	Uptime float64 `json:"uptime"`
+	// SHA-256 of the segment binary, shortened. Segments built from the
+	// same code report the same version.
+	Version string `json:"version"`
+
+	TargetSegments int32 `json:"targetSegments"`
+	// Whether some hosts are out of reach, and how many segments this
+	// side of the worm aims for meanwhile
+	Split bool  `json:"split"`
+	Goal  int32 `json:"goal"`
+	// Segments this one believes are alive, and reachable hosts without one
+	Alive   []string `json:"alive"`
+	Targets []string `json:"targets"`
+
+	// Empty if no leader is known
+	Leader string `json:"leader"`
+	Term   uint64 `json:"term"`
+	// When the leader last synced the target with this segment, or when
+	// this segment last synced the others if it is the leader. Zero if
+	// never.
+	LastSync time.Time `json:"lastSync"`
+
+	// Kill rate estimate, in kills per second, and how sure we are of it
+	// from 0 to 1
+	KillRate           float64 `json:"killRate"`
+	KillRateConfidence float64 `json:"killRateConfidence"`
+}
+
+// Encode writes s as JSON.
+func (s Status) Encode(w io.Writer) error {
+	return json.NewEncoder(w).Encode(s)
+}
+
+// Decode reads a status written by Encode.
+func Decode(r io.Reader) (Status, error) {
+	var s Status
+	err := json.NewDecoder(r).Decode(&s)
+	return s, err
+}
@@ -0,0 +1,69 @@
+package rocks
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// Hostname returns the name of the node we are running on.
+func Hostname() string {
+	if name := os.Getenv(HostnameEnv); name != "" {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+// Addr returns the host:port address to contact the service listening on
+// port (":8181" style) on node.
+func Addr(node, port string) string {
+	n, ok := lookup(node)
+	if !ok {
+		return node + port
+	}
+	host := n.Host
+	if host == "" {
+		host = n.Name
+	}
+	if n.Port == 0 {
+		return host + port
+	}
+	return net.JoinHostPort(host, shiftPort(port, n.Port))
+}
+
+// LocalAddr returns the address to contact the service listening on port
+// on the node we are running on, named self.
+func LocalAddr(self, port string) string {
+	if n, ok := lookup(self); ok && n.Port != 0 {
+		return Addr(self, port)
+	}
+	return "localhost" + port
+}
+
+// ListenAddr returns the address for a service on port (":8181" style) to
+// listen on, when running on node.
+func ListenAddr(node, port string) string {
+	n, ok := lookup(node)
+	if !ok || n.Port == 0 {
+		return port
+	}
+	// Nodes sharing the loopback interface stay off the network
+	if ip := net.ParseIP(n.Host); ip != nil && ip.IsLoopback() {
+		return net.JoinHostPort(n.Host, shiftPort(port, n.Port))
+	}
+	return ":" + shiftPort(port, n.Port)
+}
+
+// shiftPort moves port by as much as the node's worm gate port differs from
+// the configured one.
+func shiftPort(port string, nodePort int) string {
+	n, err := portNumber(port)
+	if err != nil {
+		return port
+	}
+	current.Lock()
+	base := current.base
+	current.Unlock()
+	return fmt.Sprint(n + nodePort - base)
+}
@@ -1,22 +1,60 @@
 package rocks
 
 import (
+	"fmt"
 	"log"
 	"os/exec"
 	"strings"
 )
 
-func ListNodes() []string {
+// Node is a host that may run a worm gate.
+type Node struct {
+	// Name is what the node is called in reachable host lists and in
+	// the visualizer.
+	Name string
+	// Host to connect to, if different from Name.
+	Host string
+	// Port of the worm gate on this node, if it isn't the configured
+	// one. The segment port is shifted by the same amount.
+	Port int
+}
+
+// NodeSource provides the list of nodes.
+type NodeSource interface {
+	Nodes() ([]Node, error)
+}
+
+// RocksCLI lists the compute nodes of the Rocks cluster.
+type RocksCLI struct{}
+
+func (RocksCLI) Nodes() ([]Node, error) {
 	cmdline := []string{"bash", "-c",
 		"rocks list host compute | cut -d : -f1 | sed 1d"}
 	log.Printf("Getting list of nodes: %q", cmdline)
 	cmd := exec.Command(cmdline[0], cmdline[1:]...)
 	out, err := cmd.Output()
 	if err != nil {
-		log.Panic("Error getting available nodes", err)
+		return nil, fmt.Errorf("rocks list host: %s", err)
 	}
 
 	trimmed := strings.TrimSpace(string(out))
-	nodes := strings.Split(trimmed, "\n")
-	return nodes
+	var nodes []Node
+	for _, name := range strings.Split(trimmed, "\n") {
+		nodes = append(nodes, Node{Name: name})
+	}
+	return nodes, nil
+}
+
+// ListNodes returns the names of all nodes from the node source in use.
+func ListNodes() ([]string, error) {
+	nodes, err := loadNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(nodes))
+	for i, node := range nodes {
+		names[i] = node.Name
+	}
+	return names, nil
 }
@@ -0,0 +1,62 @@
+package rocks
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// SimEnv holds the number of nodes when running a simulated cluster on
+// localhost (see sim.go). All processes of a simulated cluster, including
+// the segments started by the worm gates, inherit it, which makes
+// sim:<count> their default node source.
+const SimEnv = "WORM_SIM"
+
+// HostnameEnv overrides the host name of a process. The simulator gives
+// each worm gate its compute-x-y name with it.
+const HostnameEnv = "WORM_HOSTNAME"
+
+// SimPortStride is the distance between the ports of two simulated nodes.
+// Node i listens on the configured ports plus i*SimPortStride.
+const SimPortStride = 10
+
+// SimNodes returns the names of the nodes in a simulated cluster of n nodes.
+// They are spread over the three racks the visualizer draws, like on the
+// real cluster: compute-1-0, compute-2-0, compute-3-0, compute-1-1, ...
+func SimNodes(n int) []string {
+	nodes := make([]string, n)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("compute-%d-%d", i%3+1, i/3)
+	}
+	return nodes
+}
+
+// Sim is a simulated cluster of N nodes on 127.0.0.1, with worm gate ports
+// counting up from BasePort.
+type Sim struct {
+	N        int
+	BasePort int
+}
+
+func (s Sim) Nodes() ([]Node, error) {
+	var nodes []Node
+	for i, name := range SimNodes(s.N) {
+		nodes = append(nodes, Node{name, "127.0.0.1", s.BasePort + i*SimPortStride})
+	}
+	return nodes, nil
+}
+
+// simSize returns the number of simulated nodes given in the environment,
+// or 0 if we are not in a simulated cluster.
+func simSize() int {
+	s := os.Getenv(SimEnv)
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		log.Panicf("Bad %s=%q", SimEnv, s)
+	}
+	return n
+}
@@ -0,0 +1,250 @@
+package rocks
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The node source in use, and the nodes it gave us
+var current struct {
+	sync.Mutex
+	spec   string
+	src    NodeSource
+	base   int
+	loaded bool
+	nodes  []Node
+	byName map[string]Node
+}
+
+// DefaultSpec is the node source used unless another is given with -nodes:
+// the simulated cluster if WORM_SIM is set, the Rocks cluster otherwise.
+func DefaultSpec() string {
+	if n := simSize(); n > 0 {
+		return fmt.Sprintf("sim:%d", n)
+	}
+	return "rocks"
+}
+
+// NodesFlag adds the -nodes flag, common to all programs, to a flag set.
+func NodesFlag(flagset *flag.FlagSet, spec *string) {
+	flagset.StringVar(spec, "nodes", DefaultSpec(),
+		"node inventory: rocks, file:<path>, env:<VAR>, srv:<name> or sim:<count>")
+}
+
+// ParseSource creates a node source from a -nodes value. wormgatePort is
+// the configured worm gate port (":8181" style); simulated nodes are
+// numbered from it.
+func ParseSource(spec string, wormgatePort string) (NodeSource, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "rocks":
+		return RocksCLI{}, nil
+	case "file":
+		return StaticFile{arg}, nil
+	case "env":
+		return EnvVar{arg}, nil
+	case "srv":
+		return SRV{arg}, nil
+	case "sim":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("bad number of simulated nodes %q", arg)
+		}
+		base, err := portNumber(wormgatePort)
+		if err != nil {
+			return nil, err
+		}
+		return Sim{n, base}, nil
+	}
+	return nil, fmt.Errorf("unknown node source %q", spec)
+}
+
+// Use selects the node source for ListNodes and for resolving node names
+// to addresses. Nodes are listed the first time they are needed.
+func Use(spec string, wormgatePort string) error {
+	src, err := ParseSource(spec, wormgatePort)
+	if err != nil {
+		return err
+	}
+	base, err := portNumber(wormgatePort)
+	if err != nil {
+		return err
+	}
+
+	current.Lock()
+	defer current.Unlock()
+	current.spec = spec
+	current.src = src
+	current.base = base
+	current.loaded = false
+	return nil
+}
+
+// Spec returns the -nodes value of the node source in use, to pass on to
+// other programs.
+func Spec() string {
+	current.Lock()
+	defer current.Unlock()
+	if current.src == nil {
+		return DefaultSpec()
+	}
+	return current.spec
+}
+
+func loadNodes() ([]Node, error) {
+	current.Lock()
+	defer current.Unlock()
+
+	if current.src == nil {
+		current.spec = DefaultSpec()
+		current.base, _ = portNumber(":8181")
+		src, err := ParseSource(current.spec, ":8181")
+		if err != nil {
+			return nil, err
+		}
+		current.src = src
+	}
+	if current.loaded {
+		return current.nodes, nil
+	}
+
+	nodes, err := current.src.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	current.nodes = nodes
+	current.byName = make(map[string]Node, len(nodes))
+	for _, node := range nodes {
+		current.byName[node.Name] = node
+	}
+	current.loaded = true
+	return nodes, nil
+}
+
+// lookup finds a node by name. Nodes of the Rocks cluster are plain host
+// names, so it doesn't bother listing them, which the compute nodes can't.
+func lookup(name string) (Node, bool) {
+	current.Lock()
+	_, plain := current.src.(RocksCLI)
+	current.Unlock()
+	if plain {
+		return Node{}, false
+	}
+
+	if _, err := loadNodes(); err != nil {
+		return Node{}, false
+	}
+	current.Lock()
+	defer current.Unlock()
+	node, ok := current.byName[name]
+	if !ok {
+		node, ok = current.byName[strings.TrimSuffix(name, ".local")]
+	}
+	return node, ok
+}
+
+func portNumber(port string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(port, ":"))
+	if err != nil {
+		return 0, fmt.Errorf("bad port %q", port)
+	}
+	return n, nil
+}
+
+// parseEntries turns host[:port] strings into nodes. Nodes are named after
+// their host, or host:port if several share a host.
+func parseEntries(entries []string) ([]Node, error) {
+	var nodes []Node
+	count := make(map[string]int)
+	for _, entry := range entries {
+		host, port := entry, 0
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("bad port in %q", entry)
+			}
+			host, port = h, n
+		}
+		nodes = append(nodes, Node{Name: host, Host: host, Port: port})
+		count[host]++
+	}
+	for i := range nodes {
+		if count[nodes[i].Host] > 1 {
+			nodes[i].Name = net.JoinHostPort(nodes[i].Host, strconv.Itoa(nodes[i].Port))
+		}
+	}
+	return nodes, nil
+}
+
+// StaticFile reads nodes from a file with one host[:port] per line. Empty
+// lines and lines starting with # are ignored.
+type StaticFile struct {
+	Path string
+}
+
+func (s StaticFile) Nodes() ([]Node, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseEntries(entries)
+}
+
+// EnvVar reads nodes from an environment variable holding host[:port]
+// entries separated by spaces or commas.
+type EnvVar struct {
+	Name string
+}
+
+func (e EnvVar) Nodes() ([]Node, error) {
+	value := os.Getenv(e.Name)
+	if value == "" {
+		return nil, fmt.Errorf("environment variable %s is empty", e.Name)
+	}
+	entries := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	return parseEntries(entries)
+}
+
+// SRV looks nodes up in DNS SRV records, for example
+// _wormgate._tcp.example.org. The record ports are the worm gate ports.
+type SRV struct {
+	Name string
+}
+
+func (s SRV) Nodes() ([]Node, error) {
+	_, records, err := net.LookupSRV("", "", s.Name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, rec := range records {
+		host := strings.TrimSuffix(rec.Target, ".")
+		entries = append(entries, net.JoinHostPort(host, strconv.Itoa(int(rec.Port))))
+	}
+	return parseEntries(entries)
+}
@@ -0,0 +1,58 @@
+// Package sandbox starts segment processes with resource limits, in their own
+// process group, and optionally in their own pid and mount namespaces.
+//
+// The limits are set before the segment binary is exec'ed, so the segment
+// and anything it starts have them from the start. Limits and namespaces are
+// only supported on Linux. On other Unix systems the process still gets its
+// own process group, and the limits are ignored.
+package sandbox
+
+import (
+	"os/exec"
+	"time"
+)
+
+// Limits for a segment process. Zero means no limit.
+type Limits struct {
+	// CPU time, rounded up to seconds. The process gets SIGXCPU when it
+	// runs out, and SIGKILL a second of CPU time later.
+	CPU time.Duration
+	// Address space in bytes. Go programs reserve a fair amount of it at
+	// start, so don't go below a few hundred MiB.
+	Memory uint64
+	// Open file descriptors
+	Files uint64
+	// Namespaces runs the process in new pid and mount namespaces, if the
+	// system lets us. Without root this needs unprivileged user namespaces.
+	Namespaces bool
+}
+
+// Start starts cmd with the limits. If the namespaces can't be created, it
+// starts cmd without them and says so in the returned note. It returns the
+// command that was started, which is a copy of cmd in that case.
+func Start(cmd *exec.Cmd, l Limits) (started *exec.Cmd, note string, err error) {
+	return start(cmd, l)
+}
+
+// Kill kills the process group of a process started with Start, so that
+// anything the segment started dies with it.
+func Kill(pid int) error {
+	return kill(pid)
+}
+
+// Signal sends a signal to the process group of a process started with
+// Start.
+func Signal(pid int, sig int) error {
+	return signal(pid, sig)
+}
+
+// restart makes a fresh copy of a command that failed to start
+func restart(cmd *exec.Cmd) *exec.Cmd {
+	fresh := exec.Command(cmd.Path, cmd.Args[1:]...)
+	fresh.Env = cmd.Env
+	fresh.Dir = cmd.Dir
+	fresh.Stdin = cmd.Stdin
+	fresh.Stdout = cmd.Stdout
+	fresh.Stderr = cmd.Stderr
+	return fresh
+}
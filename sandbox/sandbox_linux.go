@@ -0,0 +1,93 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func start(cmd *exec.Cmd, l Limits) (*exec.Cmd, string, error) {
+	note := ""
+	cmd = withLimits(cmd, l)
+	if l.Namespaces {
+		cmd.SysProcAttr = namespaceAttr()
+		err := cmd.Start()
+		if err == nil {
+			return cmd, note, nil
+		}
+		if !errors.Is(err, syscall.EPERM) && !errors.Is(err, syscall.EINVAL) &&
+			!errors.Is(err, syscall.ENOSPC) {
+			return cmd, note, err
+		}
+		note = fmt.Sprintf("no namespaces (%s)", err)
+		cmd = restart(cmd)
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd, note, cmd.Start()
+}
+
+func namespaceAttr() *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{
+		Setpgid:    true,
+		Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+		// Don't let mounts made in the namespace leak out
+		Unshareflags: syscall.CLONE_NEWNS,
+	}
+	if os.Geteuid() != 0 {
+		// Be ourselves inside a new user namespace, which gives us the
+		// right to create the others
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Geteuid(), HostID: os.Geteuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getegid(), HostID: os.Getegid(), Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+	}
+	return attr
+}
+
+// withLimits returns a command that sets the limits in a shell, which then
+// execs cmd. The segment runs with them from its first instruction, and
+// everything it starts inherits them.
+func withLimits(cmd *exec.Cmd, l Limits) *exec.Cmd {
+	var script []string
+	if l.CPU > 0 {
+		seconds := (l.CPU + time.Second - 1) / time.Second
+		// SIGXCPU at the soft limit, SIGKILL at the hard one. The soft
+		// limit goes first, it can't be above the hard one.
+		script = append(script, fmt.Sprintf("ulimit -S -t %d", seconds),
+			fmt.Sprintf("ulimit -H -t %d", seconds+1))
+	}
+	if l.Memory > 0 {
+		script = append(script, fmt.Sprintf("ulimit -v %d", (l.Memory+1023)/1024))
+	}
+	if l.Files > 0 {
+		script = append(script, fmt.Sprintf("ulimit -n %d", l.Files))
+	}
+	if len(script) == 0 {
+		return cmd
+	}
+
+	args := append([]string{"-c", strings.Join(script, " && ") + ` && exec "$@"`, "sh", cmd.Path},
+		cmd.Args[1:]...)
+	wrapped := exec.Command("/bin/sh", args...)
+	wrapped.Env = cmd.Env
+	wrapped.Dir = cmd.Dir
+	wrapped.Stdin = cmd.Stdin
+	wrapped.Stdout = cmd.Stdout
+	wrapped.Stderr = cmd.Stderr
+	return wrapped
+}
+
+func kill(pid int) error {
+	return signal(pid, int(syscall.SIGKILL))
+}
+
+func signal(pid int, sig int) error {
+	return syscall.Kill(-pid, syscall.Signal(sig))
+}
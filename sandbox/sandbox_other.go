@@ -0,0 +1,25 @@
+//go:build unix && !linux
+
+package sandbox
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func start(cmd *exec.Cmd, l Limits) (*exec.Cmd, string, error) {
+	note := ""
+	if l != (Limits{}) {
+		note = "limits and namespaces are only supported on Linux"
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd, note, cmd.Start()
+}
+
+func kill(pid int) error {
+	return signal(pid, int(syscall.SIGKILL))
+}
+
+func signal(pid int, sig int) error {
+	return syscall.Kill(-pid, syscall.Signal(sig))
+}
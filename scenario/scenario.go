@@ -0,0 +1,163 @@
+// Package scenario reads timed scripts of visualizer commands, so that the
+// same experiment can be run against different worms.
+//
+// A scenario file has one step per line. Blank lines and lines starting with
+// # are ignored.
+//
+//	# time     command    argument
+//	at 0s      target     5
+//	at 10s     partition  racks
+//	after 5s   killrate   2
+//	at 30s     partition  0
+//	at 40s     killrate   0
+//	at 45s     shutdown
+//	at 50s     quit
+//
+// `at` times count from the start of the scenario, `after` times from the
+// step before. Steps must be in order. The commands are:
+//
+//	target <n>          set the target number of segments
+//	killrate <n>        set the kill rate, in kills per second
+//	partition <scheme>  switch the worm gates to a partition scheme
+//	shutdown            shut the worm down
+//	quit                stop the visualizer
+package scenario
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commands
+const (
+	Target    = "target"
+	KillRate  = "killrate"
+	Partition = "partition"
+	Shutdown  = "shutdown"
+	Quit      = "quit"
+)
+
+// Step is one command of a scenario.
+type Step struct {
+	At      time.Duration
+	Command string
+	Arg     string
+	Line    int
+}
+
+func (s Step) String() string {
+	return strings.TrimSpace(fmt.Sprintf("at %s %s %s", s.At, s.Command, s.Arg))
+}
+
+// Int returns the argument of target and killrate steps.
+func (s Step) Int() int32 {
+	n, _ := strconv.ParseInt(s.Arg, 10, 32)
+	return int32(n)
+}
+
+// Scenario is a list of steps, in order.
+type Scenario []Step
+
+// Load reads a scenario file.
+func Load(fn string) (Scenario, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	s, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%s", fn, err)
+	}
+	return s, nil
+}
+
+// Parse reads a scenario.
+func Parse(r io.Reader) (Scenario, error) {
+	var s Scenario
+	var at time.Duration
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		step, err := parseStep(strings.Fields(text), at)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", line, err)
+		}
+		step.Line = line
+		at = step.At
+		s = append(s, step)
+	}
+	return s, scanner.Err()
+}
+
+func parseStep(fields []string, prev time.Duration) (Step, error) {
+	var step Step
+	if len(fields) < 3 {
+		return step, fmt.Errorf("expected `at|after <time> <command> [argument]`")
+	}
+
+	d, err := time.ParseDuration(fields[1])
+	if err != nil || d < 0 {
+		return step, fmt.Errorf("bad time %q", fields[1])
+	}
+	switch fields[0] {
+	case "at":
+		step.At = d
+	case "after":
+		step.At = prev + d
+	default:
+		return step, fmt.Errorf("expected at or after, got %q", fields[0])
+	}
+	if step.At < prev {
+		return step, fmt.Errorf("step at %s comes before the one at %s", step.At, prev)
+	}
+
+	step.Command = fields[2]
+	args := fields[3:]
+	switch step.Command {
+	case Target, KillRate:
+		if len(args) != 1 {
+			return step, fmt.Errorf("%s takes a number", step.Command)
+		}
+		min := int64(0)
+		if step.Command == Target {
+			min = 1
+		}
+		n, err := strconv.ParseInt(args[0], 10, 32)
+		if err != nil || n < min {
+			return step, fmt.Errorf("bad %s %q", step.Command, args[0])
+		}
+		step.Arg = args[0]
+	case Partition:
+		if len(args) != 1 {
+			return step, fmt.Errorf("partition takes a scheme number or name")
+		}
+		step.Arg = args[0]
+	case Shutdown, Quit:
+		if len(args) != 0 {
+			return step, fmt.Errorf("%s takes no argument", step.Command)
+		}
+	default:
+		return step, fmt.Errorf("unknown command %q", step.Command)
+	}
+	return step, nil
+}
+
+// Run calls do for every step at its time, counted from start. It returns
+// once the last step is done.
+func (s Scenario) Run(start time.Time, do func(Step)) {
+	for _, step := range s {
+		time.Sleep(time.Until(start.Add(step.At)))
+		do(step)
+	}
+}
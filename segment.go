@@ -1,93 +1,216 @@
 package main
 
 import (
+	"./auth"
+	"./election"
+	"./killrate"
+	"./membership"
+	"./metrics"
+	"./payload"
+	"./report"
+	"./rocks"
+	"./split"
 	"flag"
 	"fmt"
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
-	"sync"
-	"hash/fnv"
-	"math"
-	"math/rand"
 )
 
 var wormgatePort string
 var segmentPort string
 
+// Tells our segments apart from other worms' at the worm gates
+var wormId string
+
+// The worm gate's proxy, which only lets requests through to reachable
+// hosts. Empty if we talk to other nodes directly.
+var proxyAddr string
+
+// Our view of the reachable hosts. While we watch the worm gate for changes
+// it is always current, otherwise it is fetched again once it is older than
+// reachableTTL.
+var reachView struct {
+	sync.RWMutex
+	hosts    []string
+	version  string
+	updated  time.Time
+	watching bool
+}
+var reachableTTL time.Duration
+
+// The worm gate sends the version of the reachable hosts in this header
+const reachableVersionHeader = "X-Worm-Reachable-Version"
+
+// errUnreachable is what requests to hosts we are cut off from fail with
+var errUnreachable = errors.New("host not reachable")
+
 var hostname string
 
 var targetSegments int32
 
 var segmentClient *http.Client
 
-var targetlist []string
-var alivelist []string
+// Shared secret for control requests, and the check for incoming ones
+var secret []byte
+var verifier *auth.Verifier
+
+// The segments alive on this side of the worm, and the reachable hosts that
+// run none. The heartbeat replaces both every round.
+var view = struct {
+	sync.RWMutex
+	alive   []string
+	targets []string
+}{}
 
 var ping int32
 
 var maxRunTime time.Duration
 
-type Lottery struct {
-	mux sync.Mutex
-	lottery []int
-}
-
-var ticket uint32
-var rticket uint32
-var ticketlist []uint32
-var winner uint32
-
-var src = rand.NewSource(time.Now().UnixNano())
-
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-
-const (
-	letterIdxBits = 6			//6 bits to represent a letter index
-	letterIdxMask = 1<<letterIdxBits - 1	//All 1-bits, as many as letterIdxBits
-	letterIdxMax = 63 / letterIdxBits 	// # of letter indices fitting in 63 bits
+var nodesSpec string
+
+var killRateWindow time.Duration
+var killEstimator *killrate.Estimator
+
+var selfName string
+
+var electionTimeout time.Duration
+var elector *election.Elector
+
+// Extra files given on the command line to ship with the segment
+var payloadFiles fileList
+
+// Key to sign payloads with, shipped along so that new segments can sign too.
+// Every segment ships a state snapshot of its own, so the payloads can't be
+// signed once and for all. The price is that the private key travels in the
+// clear to every worm gate, and whoever listens in or reads it there can
+// sign segments the worm gates will run. Use a key for the worm alone.
+var signingKeyFile string
+var signingKey ed25519.PrivateKey
+
+const signingKeyName = "segment.key"
+
+var gossipInterval time.Duration
+var gossipClient *http.Client
+var gossipReqClient *http.Client
+var members *membership.List
+
+// For GET /status
+var startTime time.Time
+var version string
+var lastSync int64 // unix nanoseconds
+
+// Set once we are on our way out, see leave
+var leaving int32
+
+// When the worm was first spread. Worm gates tell the segments of a worm
+// that was shut down from those of a new worm with the same id by it.
+var wormEpoch int64
+
+// Set once the worm is being shut down, so that we spawn no more segments
+var shuttingDown int32
+
+// errWormShutDown is what spreading to a worm gate that has the worm's
+// tombstone fails with
+var errWormShutDown = errors.New("worm was shut down")
+
+// How many segments each side keeps while the worm is split
+var partitionPolicy string
+var settleTime time.Duration
+var sides *split.Tracker
+var goal int32
+
+// Segments the leader told to shut down, until the membership finds them
+// dead. They don't count as alive meanwhile, so they aren't killed twice, and
+// their death isn't taken for a kill.
+var killed = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+const killedTimeout = 10 * time.Second
+
+// Hosts the worm never runs on
+var excludedHosts = []string{"compute-1-4", "compute-2-20"}
+
+var (
+	heartbeatDuration = metrics.NewHistogram("segment_heartbeat_round_seconds",
+		"Time spent on the work of a heartbeat round, before sleeping.",
+		[]float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5})
+	spawnAttempts = metrics.NewCounter("segment_spawn_attempts_total",
+		"Segments this segment tried to spawn.")
+	spawnFailures = metrics.NewCounter("segment_spawn_failures_total",
+		"Spawn attempts that failed.")
+	killAttempts = metrics.NewCounter("segment_kill_attempts_total",
+		"Segments this segment asked to shut down to shrink the worm.")
+	_ = metrics.NewGaugeFunc("segment_alive_segments",
+		"Segments this segment believes are alive, itself included.",
+		func() float64 { return float64(atomic.LoadInt32(&ping)) })
+	_ = metrics.NewGaugeFunc("segment_target_segments",
+		"Target number of segments.",
+		func() float64 { return float64(atomic.LoadInt32(&targetSegments)) })
+	_ = metrics.NewGaugeFunc("segment_goal_segments",
+		"Segments this side of the worm aims for, the target unless it is split.",
+		func() float64 { return float64(atomic.LoadInt32(&goal)) })
+	_ = metrics.NewGaugeFunc("segment_split",
+		"1 if some hosts are out of reach.", func() float64 {
+			if sides != nil && sides.Split() {
+				return 1
+			}
+			return 0
+		})
+	_ = metrics.NewGaugeFunc("segment_is_leader",
+		"1 if this segment is the leader.", func() float64 {
+			if elector != nil && elector.IsLeader() {
+				return 1
+			}
+			return 0
+		})
 )
 
-func RandString(n int) string {
-	b := make([]byte, n)
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMax); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
-	}
-
-	return string(b)
-
-}
-
 
 func main() {
 
-	hostname, _ = os.Hostname()
+	hostname = rocks.Hostname()
 	strip := strings.Split(hostname, ".local")
-	hn := strip[0]
-	ticket = hash(hn)
+	selfName = strip[0]
 	log.SetPrefix(hostname + " segment: ")
 
 	var spreadMode = flag.NewFlagSet("spread", flag.ExitOnError)
 	addCommonFlags(spreadMode)
 	var spreadHost = spreadMode.String("host", "localhost", "host to spread to")
+	spreadMode.Var(&payloadFiles, "payload", "extra file to ship with the segment (repeatable)")
+	spreadMode.StringVar(&signingKeyFile, "key", "", "private key file to sign the segment with")
+	var secretFile = spreadMode.String("secretfile", "", "shared secret for control requests, as written by the visualizer")
+
+	var keygenMode = flag.NewFlagSet("keygen", flag.ExitOnError)
+	var keygenFile = keygenMode.String("key", "worm.key", "private key file to create (public key goes to <file>.pub)")
 
 	var runMode = flag.NewFlagSet("run", flag.ExitOnError)
 	addCommonFlags(runMode)
+	runMode.DurationVar(&killRateWindow, "killwindow", 30*time.Second, "sliding window for the kill rate estimate")
+	runMode.DurationVar(&gossipInterval, "gossipinterval", 500*time.Millisecond, "membership protocol round")
+	runMode.DurationVar(&reachableTTL, "reachttl", time.Second, "how long to trust the reachable hosts when we can't watch them for changes")
+	runMode.StringVar(&proxyAddr, "proxy", "", "send requests to other nodes through this proxy (set by the worm gate)")
+	runMode.DurationVar(&electionTimeout, "electiontimeout", 2*time.Second, "time without word from the leader before electing a new one")
 
 	if len(os.Args) == 1 {
 		log.Fatalf("No mode specified\n")
@@ -96,9 +219,50 @@ func main() {
 	switch os.Args[1] {
 	case "spread":
 		spreadMode.Parse(os.Args[2:])
-		sendSegment(*spreadHost)
+		useDefaultWormId()
+		if err := rocks.Use(nodesSpec, wormgatePort); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := split.ParsePolicy(partitionPolicy); err != nil {
+			log.Fatal(err)
+		}
+		wormEpoch = time.Now().UnixNano()
+		if *secretFile != "" {
+			var err error
+			secret, err = auth.LoadSecret(*secretFile)
+			if err != nil {
+				log.Fatalf("Error loading secret %s: %s", *secretFile, err)
+			}
+		}
+		if signingKeyFile != "" {
+			var err error
+			signingKey, err = payload.LoadPrivateKey(signingKeyFile)
+			if err != nil {
+				log.Fatalf("Error loading key %s: %s", signingKeyFile, err)
+			}
+		}
+		err := sendSegment(*spreadHost)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "keygen":
+		keygenMode.Parse(os.Args[2:])
+		err := payload.GenerateKey(*keygenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Wrote %s and %s.pub", *keygenFile, *keygenFile)
 	case "run":
 		runMode.Parse(os.Args[2:])
+		useDefaultWormId()
+		err := rocks.Use(nodesSpec, wormgatePort)
+		if err != nil {
+			log.Fatal(err)
+		}
+		secret, err = auth.SecretFromEnv()
+		if err != nil {
+			log.Fatalf("Error reading secret from %s: %s", auth.EnvVar, err)
+		}
 		startSegmentServer()
 
 	default:
@@ -109,73 +273,162 @@ func main() {
 func addCommonFlags(flagset *flag.FlagSet) {
 	flagset.StringVar(&wormgatePort, "wp", ":8181", "wormgate port (prefix with colon)")
 	flagset.StringVar(&segmentPort, "sp", ":8182", "segment port (prefix with colon)")
+	flagset.StringVar(&wormId, "id", "", "worm id, for worm gates running several worms (default the segment port)")
 	flagset.DurationVar(&maxRunTime, "maxrun", time.Minute*10, "max time to run(in case you forget to shut down)")
+	flagset.StringVar(&partitionPolicy, "partitionpolicy", "proportional", "segments each side keeps while the worm is split: majority, proportional or full (shipped to new segments)")
+	flagset.DurationVar(&settleTime, "settle", 5*time.Second, "time to hold still after the reachable hosts change (shipped to new segments)")
+	rocks.NodesFlag(flagset, &nodesSpec)
 }
 
+func useDefaultWormId() {
+	if wormId == "" {
+		wormId = segmentPort
+	}
+}
 
-func sendSegment(address string) {
-
-	url := fmt.Sprintf("http://%s%s/wormgate?sp=%s", address, wormgatePort, segmentPort)
-	filename := "tmp.tar.gz"
+// fileList collects the values of a repeated command line flag
+type fileList []string
 
-	log.Printf("Spreading to %s", url)
+func (f *fileList) String() string {
+	return strings.Join(*f, ",")
+}
 
-	// ship the binary and the qml file that describes our screen output
-	tarCmd := exec.Command("tar", "-zc", "-f", filename, "segment")
-	tarCmd.Run()
-	defer os.Remove(filename)
+func (f *fileList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
 
-	file, err := os.Open(filename)
+// payloadDir is where the worm gate extracted the files we were shipped with
+func payloadDir() string {
+	binary, err := os.Executable()
 	if err != nil {
-		log.Panic("Could not read input file", err)
+		return payload.Dir
 	}
+	return filepath.Join(filepath.Dir(binary), payload.Dir)
+}
 
-	resp, err := http.Post(url, "string", file)
-	if err != nil {
-		log.Panic("POST error ", err)
+// payloadExtras lists the extra files to ship with a new segment: the files
+// given with -payload, the files we were shipped with ourselves, and a
+// snapshot of our current state.
+func payloadExtras() []payload.File {
+	var extras []payload.File
+	for _, fn := range payloadFiles {
+		extras = append(extras, payload.File{Name: filepath.Base(fn), Path: fn})
+	}
+	// The private key, in the clear, see signingKeyFile
+	if signingKeyFile != "" {
+		extras = append(extras, payload.File{Name: signingKeyName, Path: signingKeyFile, Mode: 0600})
 	}
 
-	io.Copy(ioutil.Discard, resp.Body)
-	resp.Body.Close()
-
-	if resp.StatusCode == 200 {
-		log.Println("Received OK from server")
-	} else {
-		log.Println("Response: ", resp)
+	shipped, _ := ioutil.ReadDir(payloadDir())
+	for _, info := range shipped {
+		if info.Mode().IsRegular() && info.Name() != "state" {
+			fn := filepath.Join(payloadDir(), info.Name())
+			extras = append(extras, payload.File{Name: info.Name(), Path: fn,
+				Mode: int64(info.Mode().Perm())})
+		}
 	}
+
+	state := fmt.Sprintf("targetsegments %d\npartitionpolicy %s\nsettle %s\nepoch %d\n",
+		atomic.LoadInt32(&targetSegments), partitionPolicy, settleTime, wormEpoch)
+	extras = append(extras, payload.File{Name: "state", Data: []byte(state)})
+	return extras
 }
 
-func createClient() *http.Client {
-	return &http.Client{
-		Transport: &http.Transport{},
+// loadState picks up the state snapshot shipped by the segment that
+// spawned us, if any.
+func loadState() {
+	file, err := os.Open(filepath.Join(payloadDir(), "state"))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var key, value string
+		pc, err := fmt.Sscan(scanner.Text(), &key, &value)
+		if pc != 2 || err != nil {
+			log.Printf("Error parsing state snapshot line %q: %s", scanner.Text(), err)
+			continue
+		}
+		switch key {
+		case "targetsegments":
+			var ts int32
+			if _, err := fmt.Sscan(value, &ts); err != nil {
+				log.Printf("Error parsing state snapshot target %q: %s", value, err)
+				continue
+			}
+			atomic.StoreInt32(&targetSegments, ts)
+		case "partitionpolicy":
+			partitionPolicy = value
+		case "epoch":
+			if _, err := fmt.Sscan(value, &wormEpoch); err != nil {
+				log.Printf("Error parsing state snapshot epoch %q: %s", value, err)
+			}
+		case "settle":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				log.Printf("Error parsing state snapshot settle time %q: %s", value, err)
+				continue
+			}
+			settleTime = d
+		}
 	}
 }
 
+func sendSegment(address string) error {
 
+	url := fmt.Sprintf("http://%s/wormgate?sp=%s&id=%s&epoch=%d",
+		rocks.Addr(address, wormgatePort), segmentPort, wormId, wormEpoch)
 
-func httpGetOk(client *http.Client, url string) (bool, string, error) {
-	resp, err := client.Get(url)
-	isOk := err == nil && resp.StatusCode == 200
-	body := ""
+	log.Printf("Spreading to %s", url)
+
+	binary, err := os.Executable()
 	if err != nil {
-		if strings.Contains(fmt.Sprint(err), "connection refused") {
-			// ignore connection refused errors
-			err = nil
-		} else {
-			log.Printf("Error checking %s: %s", url, err)
-		}
-	} else {
-		var bytes []byte
-		bytes, err = ioutil.ReadAll(resp.Body)
-		body = string(bytes)
-		resp.Body.Close()
+		return fmt.Errorf("could not find segment binary: %s", err)
+	}
+
+	// Stream the archive straight into the request body
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(payload.Write(pw, binary, payloadExtras(), signingKey))
+	}()
+
+	resp, err := createClient().Post(url, "application/gzip", pr)
+	pr.Close()
+	if err != nil {
+		return fmt.Errorf("POST error: %s", err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return errWormShutDown
 	}
-	return isOk, body, err
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("response %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	log.Println("Received OK from server")
+	return nil
 }
 
+func createClient() *http.Client {
+	transport := &http.Transport{}
+	if proxyAddr != "" {
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr})
+	}
+	return &http.Client{
+		Transport: &auth.Transport{Secret: secret, Base: transport},
+	}
+}
 
 func doBcastPost(node string) error {
-	url := fmt.Sprintf("http://%s%s/sync", node, segmentPort)
+	if !isReachable(node) {
+		return errUnreachable
+	}
+	url := fmt.Sprintf("http://%s/sync", rocks.Addr(node, segmentPort))
 	postBody := strings.NewReader(fmt.Sprint(targetSegments))
 
 	resp, err := segmentClient.Post(url, "text/plain", postBody)
@@ -190,15 +443,18 @@ func doBcastPost(node string) error {
 
 }
 
-func doBcastTicket(node string) error {
-	random := RandString(10)
-	rticket = hash(random)
-	url := fmt.Sprintf("http://%s%s/ticket", node, segmentPort)
-	postBody := strings.NewReader(fmt.Sprint(rticket))
+func doBcastDeaths(node string) error {
+	if !isReachable(node) {
+		return errUnreachable
+	}
+	url := fmt.Sprintf("http://%s/deaths", rocks.Addr(node, segmentPort))
+	since, deaths := killEstimator.Recent(time.Now())
+	postBody := new(bytes.Buffer)
+	killrate.Encode(postBody, since, deaths)
 
 	resp, err := segmentClient.Post(url, "text/plain", postBody)
 	if err != nil && !strings.Contains(fmt.Sprint(err), "refused") {
-		log.Printf("Error ticket %s: %s", node, err)
+		log.Printf("Error deaths %s: %s", node, err)
 	}
 	if err == nil {
 		io.Copy(ioutil.Discard, resp.Body)
@@ -207,10 +463,73 @@ func doBcastTicket(node string) error {
 	return err
 }
 
+func doElectionPost(node string, m election.Message) bool {
+	if !isReachable(node) {
+		return false
+	}
+	url := fmt.Sprintf("http://%s/election", rocks.Addr(node, segmentPort))
+	postBody := strings.NewReader(m.String())
+
+	resp, err := segmentClient.Post(url, "text/plain", postBody)
+	if err != nil && !strings.Contains(fmt.Sprint(err), "refused") {
+		log.Printf("Error election %s: %s", node, err)
+	}
+	if err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return err == nil && resp.StatusCode == 200
+}
+
+// gossipTransport carries membership protocol messages over HTTP
+type gossipTransport struct{}
+
+func (gossipTransport) Ping(node string, m membership.Message) (membership.Message, bool) {
+	if !isReachable(node) {
+		return membership.Message{}, false
+	}
+	url := fmt.Sprintf("http://%s/ping", rocks.Addr(node, segmentPort))
+	return doGossipPost(gossipClient, url, m)
+}
+
+func (gossipTransport) PingReq(via, target string, m membership.Message) (membership.Message, bool) {
+	if !isReachable(via) {
+		return membership.Message{}, false
+	}
+	query := url.Values{"target": {target}}
+	reqUrl := fmt.Sprintf("http://%s/pingreq?%s", rocks.Addr(via, segmentPort), query.Encode())
+	return doGossipPost(gossipReqClient, reqUrl, m)
+}
+
+func doGossipPost(client *http.Client, url string, m membership.Message) (membership.Message, bool) {
+	postBody := new(bytes.Buffer)
+	m.Encode(postBody)
+
+	resp, err := client.Post(url, "text/plain", postBody)
+	if err != nil {
+		return membership.Message{}, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return membership.Message{}, false
+	}
+
+	ack, err := membership.DecodeMessage(resp.Body)
+	if err != nil {
+		log.Printf("Error parsing ack from %s: %s", url, err)
+		return ack, false
+	}
+	return ack, true
+}
+
 func doWormShutdownPost(node string) error {
+	if !isReachable(node) {
+		return errUnreachable
+	}
 	log.Printf("Posting killsegment to %s", node)
 
-	url := fmt.Sprintf("http://%s%s/killsegments", node, segmentPort)
+	url := fmt.Sprintf("http://%s/killsegments", rocks.Addr(node, segmentPort))
 
 	resp, err := segmentClient.PostForm(url, nil)
 	if err != nil && !strings.Contains(fmt.Sprint(err), "refused") {
@@ -232,6 +551,7 @@ func syncHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	atomic.StoreInt32(&targetSegments, ts)
+	atomic.StoreInt64(&lastSync, time.Now().UnixNano())
 	// Consume and close body
 	io.Copy(ioutil.Discard, r.Body)
 	r.Body.Close()
@@ -240,166 +560,299 @@ func syncHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Received sync command")
 }
 
-func calculate_diff(a uint32, b uint32) uint32{
-	f := float64(a)
-	f2 := float64(b)
+func deathsHandler(w http.ResponseWriter, r *http.Request) {
+	since, deaths, err := killrate.Decode(r.Body)
 
-	diff := f - f2
-	abs := math.Abs(diff)
+	// Consume and close body
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
 
-	return uint32(abs)
+	if err != nil {
+		// A bad since would make us believe we have observed forever
+		log.Printf("Error parsing deaths: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	killEstimator.Merge(since, deaths)
 }
 
-func find_winner() {
-	//Check if ur the winner or loser
-	var lowest uint32
-	lowest = 0
+func killRateHandler(w http.ResponseWriter, r *http.Request) {
 
-	for _, num := range ticketlist {
-		//log.Printf("Enter")
-		diff := calculate_diff(num, rticket)
+	// We don't use the request body. But we should consume it anyway.
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
 
-		if lowest == 0 {
-			lowest = diff
-			winner = num
-		} else {
-			if lowest > diff {
-				lowest = diff
-				winner = num
-			}
-		}
+	rate, confidence := killEstimator.Estimate(time.Now())
+	fmt.Fprintf(w, "%.3f %.3f\n", rate, confidence)
+}
+
+func electionHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		log.Printf("Error reading election message: %s", err)
+		return
 	}
-	if winner == ticket {
-		if ping < targetSegments {
-			spawn_seg()
-		} else if ping > targetSegments {
-			//kill seg
-			kill_seg()
-		}
+
+	if atomic.LoadInt32(&leaving) != 0 {
+		// Don't let anyone wait for us to take over
+		http.Error(w, "Leaving", http.StatusServiceUnavailable)
+		return
 	}
 
+	m, err := election.ParseMessage(string(body))
+	if err != nil {
+		log.Printf("Error parsing election message: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	elector.Handle(m, time.Now())
 }
 
-func lotteryHandler(w http.ResponseWriter, r *http.Request) {
-	var t uint32
+// leave tells the others we are going, so that they don't have to find out
+// by themselves: we are gone as far as the membership goes, and if we led the
+// worm, a new leader is elected right away. A voluntary leave doesn't count
+// as a kill.
+func leave(voluntary bool) {
+	atomic.StoreInt32(&leaving, 1)
+	log.Printf("Leaving the worm")
+	members.Leave(time.Now(), voluntary)
+	elector.Resign()
+}
 
-	pc, rateErr := fmt.Fscanf(r.Body, "%d", &t)
-	if pc != 1 || rateErr != nil {
-		log.Printf("Error parsing lotteryticket (%d items): %s", pc, rateErr)
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	m, err := membership.DecodeMessage(r.Body)
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+	if err != nil {
+		log.Printf("Error parsing ping: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	atomic.StoreUint32(&rticket, t)
-	// Consume and close body
+	ack := members.HandlePing(m, time.Now())
+	ack.Encode(w)
+}
+
+func pingReqHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	m, err := membership.DecodeMessage(r.Body)
 	io.Copy(ioutil.Discard, r.Body)
 	r.Body.Close()
+	if err != nil || target == "" {
+		log.Printf("Error parsing ping-req for %q: %v", target, err)
+		http.Error(w, "Bad ping-req", http.StatusBadRequest)
+		return
+	}
 
-	find_winner()
+	ack, ok := members.HandlePingReq(target, m, time.Now())
+	if !ok {
+		http.Error(w, "No answer from "+target, http.StatusGatewayTimeout)
+		return
+	}
+	ack.Encode(w)
 }
 
-func contains(s []string, e string) bool {
-	for _, a := range s {
-		if a == e {
-			return true
-		}
+func leaderHandler(w http.ResponseWriter, r *http.Request) {
+
+	// We don't use the request body. But we should consume it anyway.
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+
+	leader, term := elector.Leader()
+	if leader == "" {
+		leader = "-"
 	}
-	return false
+	fmt.Fprintf(w, "%s %d\n", leader, term)
 }
 
-func remove(slice []string, s string) {
-	for i, a := range slice {
-		if s == a {
-			targetlist = append(slice[:i], slice[i+1:]...)
-		}
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+
+	// We don't use the request body. But we should consume it anyway.
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+
+	now := time.Now()
+	leader, term := elector.Leader()
+	rate, confidence := killEstimator.Estimate(now)
+	alive, targets := wormView()
+	status := report.Status{
+		Hostname:           selfName,
+		Started:            startTime,
+		Uptime:             now.Sub(startTime).Seconds(),
+		Version:            version,
+		TargetSegments:     atomic.LoadInt32(&targetSegments),
+		Split:              sides.Split(),
+		Goal:               atomic.LoadInt32(&goal),
+		Alive:              alive,
+		Targets:            targets,
+		Leader:             leader,
+		Term:               term,
+		KillRate:           rate,
+		KillRateConfidence: confidence,
 	}
+	if synced := atomic.LoadInt64(&lastSync); synced != 0 {
+		status.LastSync = time.Unix(0, synced)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	status.Encode(w)
 }
 
-func remove3(slice []string, s string) {
-	for i, a := range slice {
-		if s == a {
-			alivelist = append(slice[:i], slice[i+1:]...)
-		}
+// binaryVersion identifies the code we run by the hash of our binary
+func binaryVersion() string {
+	binary, err := os.Executable()
+	if err != nil {
+		return "unknown"
 	}
+	data, err := ioutil.ReadFile(binary)
+	if err != nil {
+		return "unknown"
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
 }
 
-func hash(s string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(s))
-	return h.Sum32()
+// reconcile spawns or kills segments to reach targetSegments, or this
+// side's share of it while the worm is split. Only the leader makes these
+// decisions, once per heartbeat round.
+func reconcile() {
+	reconciling.Lock()
+	defer reconciling.Unlock()
+	if atomic.LoadInt32(&shuttingDown) != 0 {
+		return
+	}
+	g := updateGoal()
+	alive, targets := wormView()
+	if n := int32(len(alive)); n < g {
+		spawn_seg(g, alive, targets)
+	} else if n > g {
+		kill_seg(g, alive)
+	}
+}
 
+// wormView returns copies of the segments alive on this side, and the
+// reachable hosts that run none
+func wormView() (alive, targets []string) {
+	view.RLock()
+	defer view.RUnlock()
+	return append([]string(nil), view.alive...), append([]string(nil), view.targets...)
+}
+
+func setWormView(alive, targets []string) {
+	view.Lock()
+	view.alive, view.targets = alive, targets
+	view.Unlock()
+	atomic.StoreInt32(&ping, int32(len(alive)))
+}
+
+// Spawning and killing go one round at a time
+var reconciling sync.Mutex
+
+// updateGoal works out how many segments this side of the worm aims for
+func updateGoal() int32 {
+	ts := atomic.LoadInt32(&targetSegments)
+	g := int32(sides.Goal(int(ts), int(atomic.LoadInt32(&ping)), time.Now()))
+	atomic.StoreInt32(&goal, g)
+	return g
+}
+
+// wormHosts returns all hosts the worm may run on
+func wormHosts() ([]string, error) {
+	nodes, err := rocks.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, host := range nodes {
+		if !contains(excludedHosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
 }
 
 func heartbeat() {
 	segmentClient = createClient()
-	list := fetchReachableHosts()
-	targetlist = fetchReachableHosts()
 
 	for {
-		ping = 0
-		for _, addr := range list {
-			if addr == hostname || addr+".local" == hostname {
-				ping++
-				if contains(alivelist, addr) == false {
-					tmp := hash(addr)
-					ticketlist = append(ticketlist, tmp)
-					alivelist = append(alivelist, addr)
-				}
-				if contains(targetlist, addr) == true {
-					remove(targetlist, addr)
-				}
-
+		roundStart := time.Now()
+
+		reachable := reachableHosts()
+		if sides.Update(reachable, time.Now()) {
+			if sides.Split() {
+				side, all := sides.Size()
+				log.Printf("Worm split, %d of %d hosts reachable: keeping the %s share after %s",
+					side, all, partitionPolicy, settleTime)
 			} else {
-				segmentUrl := fmt.Sprintf("http://%s%s/", addr, segmentPort)
-				segment, _, _ := httpGetOk(segmentClient, segmentUrl)
-
-				if segment == true {
-					ping++
-					if contains(alivelist, addr) == false {
-						tmp := hash(addr)
-						ticketlist = append(ticketlist, tmp)
-						alivelist = append(alivelist, addr)
-					}
-					if contains(targetlist, addr) == true {
-						remove(targetlist, addr)
-					}
-				} else {
-					if contains(alivelist, addr) == true {
-						remove3(alivelist, addr)
-						targetlist = append(targetlist, addr)
-					}
-				}
+				log.Printf("Worm healed, settling for %s before merging", settleTime)
+			}
+		}
+		members.Tick(time.Now(), reachable)
+
+		// Segments out of reach may not have been found dead yet, but
+		// they don't count on this side
+		var alivelist []string
+		alive := members.Alive()
+		killed.Lock()
+		for host, when := range killed.m {
+			if time.Since(when) > killedTimeout {
+				delete(killed.m, host)
+			}
+		}
+		for _, addr := range alive {
+			_, dying := killed.m[addr]
+			if addr == selfName || (contains(reachable, addr) && !dying) {
+				alivelist = append(alivelist, addr)
 			}
 		}
-		//synce ogsa gjore lotteri
-		if len(alivelist) > 1 && targetSegments > 1 {
+		killed.Unlock()
+		var notrunning []string
+		for _, addr := range reachable {
+			if addr != selfName && !contains(alivelist, addr) {
+				notrunning = append(notrunning, addr)
+			}
+		}
+		setWormView(alivelist, notrunning)
+
+		elector.Tick(time.Now())
+
+		if elector.IsLeader() {
 			for _, addr := range alivelist {
-				if addr != hostname || addr+".local" != hostname {
+				if addr != selfName {
 					//Sync targseg
 					doBcastPost(addr)
-
 				}
 			}
-			//start lottery fordi alle har fatt sync
-			for _, addr := range alivelist {
-				if addr != hostname || addr+".local" != hostname {
-					//Start lottery
-					doBcastTicket(addr)
-					find_winner()
-				}
-			}
-			if winner == ticket {
-				if ping < targetSegments {
-					spawn_seg()
-				} else if ping > targetSegments {
-					//kill seg
-					kill_seg()
-				}
+			atomic.StoreInt64(&lastSync, time.Now().UnixNano())
+		}
+		// Deaths also spread by gossip, one peer per round is enough
+		if len(alivelist) > 1 {
+			peer := alivelist[rand.Intn(len(alivelist))]
+			if peer != selfName {
+				doBcastDeaths(peer)
 			}
-
+		}
+		if elector.IsLeader() {
+			reconcile()
+		} else {
+			updateGoal()
 		}
 
-		//log.Printf("\nHeartbeats: %d\n\ntargetSeg: %d\n\nTargetlist: %s \nLotteryNUM: %d\n", ping, targetSegments, targetlist, rticket)
+		//log.Printf("\nHeartbeats: %d\n\ntargetSeg: %d\n\nTargetlist: %s\n", ping, targetSegments, targetlist)
 		//log.Printf("\nActive list: %s\n", alivelist)
 
+		heartbeatDuration.Observe(time.Since(roundStart).Seconds())
+		time.Sleep(gossipInterval - time.Since(roundStart))
 	}
 
 }
@@ -414,20 +867,102 @@ func startSegmentServer() {
 		os.Exit(0)
 	}()
 
+	startTime = time.Now()
+	version = binaryVersion()
+
+	loadState()
+
+	policy, err := split.ParsePolicy(partitionPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hosts, err := wormHosts()
+	if err != nil {
+		log.Fatalf("Error getting available nodes: %s", err)
+	}
+	sides = split.New(policy, settleTime, hosts, time.Now())
+
+	// Sign the segments we spawn with the key we were shipped with, if any
+	keyFile := filepath.Join(payloadDir(), signingKeyName)
+	if _, err := os.Stat(keyFile); err == nil {
+		signingKey, err = payload.LoadPrivateKey(keyFile)
+		if err != nil {
+			log.Printf("Error loading signing key: %s", err)
+		}
+	}
+
+	killEstimator = killrate.New(killRateWindow, time.Now())
+	// Direct pings must time out before the ping-reqs that wrap them
+	gossipClient = createClient()
+	gossipClient.Timeout = gossipInterval / 4
+	gossipReqClient = createClient()
+	gossipReqClient.Timeout = gossipInterval / 2
+	members = membership.New(selfName, membership.DefaultConfig, gossipTransport{}, time.Now())
+	// Only kills count towards the kill rate, not the segments the
+	// leader shut down to meet the target
+	members.OnDeath = func(host string, incarnation uint64, left bool) {
+		killed.Lock()
+		_, dying := killed.m[host]
+		delete(killed.m, host)
+		killed.Unlock()
+		switch {
+		case left:
+			log.Printf("Segment on %s left", host)
+		case dying:
+			log.Printf("Segment on %s shut down", host)
+		default:
+			log.Printf("Segment on %s died", host)
+			killEstimator.Observe(host, incarnation, time.Now())
+		}
+	}
+	setWormView(members.Alive(), nil)
+	elector = election.New(selfName, electionTimeout, time.Now(),
+		func() []string {
+			alive, _ := wormView()
+			return alive
+		}, doElectionPost)
+
+	// The worm gate asks us to go with SIGTERM before it kills us
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM)
+	go func() {
+		<-terminate
+		leave(false)
+		exitReason <- "Got SIGTERM, left the worm"
+	}()
+
+	// Worm gates forget tombstones after maxrun, no segment may outlive it
+	time.AfterFunc(maxRunTime, func() {
+		leave(true)
+		exitReason <- fmt.Sprintf("maxrun timeout: %s", maxRunTime)
+	})
+
+	verifier = auth.NewVerifier(secret, 30*time.Second)
+
 	http.HandleFunc("/", IndexHandler)
-	http.HandleFunc("/targetsegments", targetSegmentsHandler)
-	http.HandleFunc("/shutdown", shutdownHandler)
-	http.HandleFunc("/sync", syncHandler)
-	http.HandleFunc("/ticket", lotteryHandler)
-	http.HandleFunc("/killsegments", killsegmentsHandler)
+	http.HandleFunc("/killrate", killRateHandler)
+	http.HandleFunc("/leader", leaderHandler)
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/metrics", metrics.Handler)
+
+	// Everything that changes state needs the shared secret
+	http.HandleFunc("/deaths", verifier.Require(deathsHandler))
+	http.HandleFunc("/targetsegments", verifier.Require(targetSegmentsHandler))
+	http.HandleFunc("/shutdown", verifier.Require(shutdownHandler))
+	http.HandleFunc("/sync", verifier.Require(syncHandler))
+	http.HandleFunc("/election", verifier.Require(electionHandler))
+	http.HandleFunc("/ping", verifier.Require(pingHandler))
+	http.HandleFunc("/pingreq", verifier.Require(pingReqHandler))
+	http.HandleFunc("/killsegments", verifier.Require(killsegmentsHandler))
 
 	log.Printf("Starting segment server on %s%s\n", hostname, segmentPort)
-	log.Printf("Reachable hosts: %s", strings.Join(fetchReachableHosts()," "))
+	go watchReachableHosts()
+	log.Printf("Reachable hosts: %s", strings.Join(reachableHosts()," "))
 
 
 	go heartbeat()
 
-	err := http.ListenAndServe(segmentPort, nil)
+	err = http.ListenAndServe(rocks.ListenAddr(selfName, segmentPort), nil)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -439,24 +974,72 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	io.Copy(ioutil.Discard, r.Body)
 	r.Body.Close()
 
-	killRateGuess := 2.0
+	killRateGuess, _ := killEstimator.Estimate(time.Now())
 
 	fmt.Fprintf(w, "%.3f\n", killRateGuess)
 }
 
-func kill_seg() {
-	for _, addr := range alivelist[:ping - targetSegments] {
+func kill_seg(goal int32, alive []string) {
+	excess := len(alive) - int(goal)
+	for _, addr := range alive {
+		if excess <= 0 || !elector.IsLeader() {
+			break
+		}
+		// The leader keeps itself alive, killing it would only
+		// trigger a new election.
+		if addr == selfName {
+			continue
+		}
 		log.Printf("Host: %s tries to kill: %s", hostname, addr)
-		doWormShutdownPost(addr)
+		killAttempts.Inc()
+		// The segment exits without answering, so an error doesn't
+		// mean it lives on
+		if doWormShutdownPost(addr) == errUnreachable {
+			continue
+		}
+		killed.Lock()
+		killed.m[addr] = time.Now()
+		killed.Unlock()
+		excess--
 	}
 
 }
 
 
-func spawn_seg() {
-	for _, addr := range targetlist[:targetSegments-ping] {
+func spawn_seg(goal int32, alive, targets []string) {
+	missing := int(goal) - len(alive)
+	if missing > len(targets) {
+		missing = len(targets)
+	}
+	for _, addr := range targets[:missing] {
+		// We may have lost the leadership while spreading
+		if !elector.IsLeader() {
+			return
+		}
+		if !isReachable(addr) {
+			continue
+		}
 		log.Printf("Host: %s tries to boot: %s", hostname, addr)
-		sendSegment(addr)
+		spawnAttempts.Inc()
+		err := sendSegment(addr)
+		if err == errWormShutDown {
+			// Shut down while we were out of reach. Our side goes too.
+			spawnFailures.Inc()
+			if atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+				log.Printf("Worm gate on %s says the worm was shut down", addr)
+				go func() {
+					log.Print(shutdownSummary(buryWorm()))
+					endWorm()
+				}()
+			}
+			return
+		}
+		if err != nil {
+			spawnFailures.Inc()
+			log.Printf("Error spreading to %s: %s", addr, err)
+			continue
+		}
+		members.Join(addr, time.Now())
 		doBcastPost(addr)
 	}
 
@@ -476,64 +1059,150 @@ func targetSegmentsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("New targetSegments: %d", ts)
 	atomic.StoreInt32(&targetSegments, ts)
 
+	// Hand the new target to the leader, it syncs everyone else. The
+	// leader acts on it in its next heartbeat round.
+	leader, _ := elector.Leader()
+	if leader != "" && leader != selfName {
+		doBcastPost(leader)
+		return
+	}
 
-	if len(alivelist) > 1 {
-		for _, addr := range alivelist {
-			if addr != hostname || addr+".local" != hostname {
-				//Sync targseg
-				doBcastPost(addr)
-
-			}
-		}
-		//start lottery fordi alle har fatt sync
-		for _, addr := range alivelist {
-			if addr != hostname || addr+".local" != hostname {
-				//Start lottery
-				doBcastTicket(addr)
-				find_winner()
-			}
-		}
-	} else {
-		if ping < targetSegments {
-			for _, addr := range targetlist[:targetSegments-ping] {
-				sendSegment(addr)
-				doBcastPost(addr)
-			}
+	alive, _ := wormView()
+	for _, addr := range alive {
+		if addr != selfName {
+			//Sync targseg
+			doBcastPost(addr)
 		}
 	}
 }
 
 
+// shutdownHandler shuts the whole worm down. Every reachable worm gate gets
+// the worm's tombstone: it stops the segment it runs, and refuses any that
+// still come along. Our own worm gate goes last, it stops us and passes the
+// tombstone on to the worm gates out of reach once they are back. The answer
+// says what each worm gate did.
 func shutdownHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Consume and close body
 	io.Copy(ioutil.Discard, r.Body)
 	r.Body.Close()
 
-	list := fetchReachableHosts()
+	log.Printf("Received shutdown command")
+	summary := shutdownSummary(buryWorm())
 
-	for {
-		deathping := 0
-		for _, addr := range list {
-			if addr+".local" != hostname {
-				segmentUrl := fmt.Sprintf("http://%s%s/", addr, segmentPort)
-				segment, _, _ := httpGetOk(segmentClient, segmentUrl)
-
-				if segment == true {
-					deathping++
-					doWormShutdownPost(addr)
-				}
-			}
+	// All of it, before our worm gate stops us
+	w.Header().Set("Content-Length", fmt.Sprint(len(summary)))
+	io.WriteString(w, summary)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	go endWorm()
+}
+
+// burial is what a worm gate said to the worm's tombstone
+type burial struct {
+	host   string
+	answer string
+	err    error
+}
+
+// buryWorm gives the worm's tombstone to the reachable worm gates, except
+// ours
+func buryWorm() []burial {
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	var burials []burial
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	hosts, err := wormHosts()
+	if err != nil {
+		// Our worm gate hands the tombstone on to the rest
+		log.Printf("Error getting available nodes, burying the worm on the reachable hosts: %s", err)
+		hosts = reachableHosts()
+	}
+	for _, host := range hosts {
+		if host == selfName {
+			continue
 		}
-		if deathping == 0 {
-			// Shut down
-			log.Printf("Received shutdown command, committing suicide")
-			os.Exit(0)
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			answer, err := postTombstone(host)
+			mu.Lock()
+			burials = append(burials, burial{host, answer, err})
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	sort.Slice(burials, func(i, j int) bool { return burials[i].host < burials[j].host })
+	return burials
+}
+
+// shutdownSummary says which worm gates have the tombstone, and which
+// segments they stopped
+func shutdownSummary(burials []burial) string {
+	var b strings.Builder
+	acked, stopped := 0, 0
+	fmt.Fprintf(&b, "%s: this segment, stopped by its worm gate next\n", selfName)
+	for _, burial := range burials {
+		switch {
+		case burial.err == errUnreachable:
+			fmt.Fprintf(&b, "%s: out of reach, gets the tombstone from our worm gate later\n", burial.host)
+		case burial.err != nil:
+			fmt.Fprintf(&b, "%s: error: %s\n", burial.host, burial.err)
+		default:
+			acked++
+			if !strings.HasPrefix(burial.answer, "No segment") {
+				stopped++
+			}
+			fmt.Fprintf(&b, "%s: %s\n", burial.host, burial.answer)
 		}
 	}
+	fmt.Fprintf(&b, "Shut down worm %s: %d of %d other worm gates acknowledged and stopped %d segments\n",
+		wormId, acked, len(burials), stopped)
+	return b.String()
+}
 
-	// Shut down
-	log.Printf("Received shutdown command, committing suicide")
+// postTombstone gives the worm's tombstone to the worm gate on node, and
+// returns its answer. Other worm gates get it as relayed, ours passes it on.
+func postTombstone(node string) (string, error) {
+	if !isReachable(node) {
+		return "", errUnreachable
+	}
+	var url string
+	var client *http.Client
+	if node == selfName {
+		url = fmt.Sprintf("http://%s/tombstone?id=%s&epoch=%d",
+			rocks.LocalAddr(selfName, wormgatePort), wormId, wormEpoch)
+		// Not through the proxy, which only knows other nodes
+		client = &http.Client{Transport: &auth.Transport{Secret: secret, Base: &http.Transport{}}}
+	} else {
+		url = fmt.Sprintf("http://%s/tombstone?id=%s&epoch=%d&relayed=1",
+			rocks.Addr(node, wormgatePort), wormId, wormEpoch)
+		client = createClient()
+	}
+	client.Timeout = 30 * time.Second
+
+	resp, err := client.Post(url, "text/plain", nil)
+	if err != nil {
+		return "", err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	answer := strings.TrimSpace(string(body))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, answer)
+	}
+	return answer, nil
+}
+
+// endWorm gives the tombstone to our own worm gate, which stops us
+func endWorm() {
+	if _, err := postTombstone(selfName); err != nil {
+		log.Printf("Error posting tombstone to our worm gate: %s", err)
+	}
+	log.Printf("Worm shut down, committing suicide")
 	os.Exit(0)
 }
 
@@ -545,37 +1214,110 @@ func killsegmentsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Shut down
 	log.Printf("Received killsegment command, committing suicide")
+	leave(true)
 	os.Exit(0)
 }
 
-func remove2(slice []string, s int) []string {
-	return append(slice[:s], slice[s+1:]...)
+
+// reachableHosts returns the hosts we may talk to. Don't modify the list.
+func reachableHosts() []string {
+	reachView.RLock()
+	hosts := reachView.hosts
+	fresh := reachView.watching || time.Since(reachView.updated) < reachableTTL
+	reachView.RUnlock()
+	if fresh {
+		return hosts
+	}
+
+	hosts, version, err := getReachableHosts(http.DefaultClient, "")
+	if err != nil {
+		hosts = []string{}
+	}
+	setReachableHosts(hosts, version, false)
+	return hosts
+}
+
+// isReachable checks whether we may talk to a host
+func isReachable(node string) bool {
+	if node == selfName {
+		return true
+	}
+	for _, host := range reachableHosts() {
+		if host == node {
+			return true
+		}
+	}
+	return false
+}
+
+func setReachableHosts(hosts []string, version string, watching bool) {
+	reachView.Lock()
+	defer reachView.Unlock()
+	if version != reachView.version && reachView.hosts != nil {
+		log.Printf("Reachable hosts changed: %s", strings.Join(hosts, " "))
+	}
+	reachView.hosts = hosts
+	reachView.version = version
+	reachView.updated = time.Now()
+	reachView.watching = watching
+}
+
+// watchReachableHosts keeps our view of the reachable hosts current, by
+// asking the worm gate to answer when they change
+func watchReachableHosts() {
+	// The worm gate answers after a while even if nothing changed
+	client := &http.Client{Timeout: time.Minute}
+	version := ""
+	for {
+		hosts, newVersion, err := getReachableHosts(client, version)
+		if err != nil || newVersion == "" {
+			// Fall back on fetching them when they get too old
+			reachView.Lock()
+			reachView.watching = false
+			reachView.Unlock()
+			version = ""
+			time.Sleep(time.Second)
+			continue
+		}
+		setReachableHosts(hosts, newVersion, true)
+		version = newVersion
+	}
 }
 
-func fetchReachableHosts() []string {
-	url := fmt.Sprintf("http://localhost%s/reachablehosts", wormgatePort)
-	resp, err := http.Get(url)
+// getReachableHosts asks the worm gate for the reachable hosts. Given the
+// version we have, it waits for them to change first. It returns the hosts
+// and their version.
+func getReachableHosts(client *http.Client, version string) ([]string, string, error) {
+	url := fmt.Sprintf("http://%s/reachablehosts", rocks.LocalAddr(selfName, wormgatePort))
+	if version != "" {
+		url += "?watch=1&version=" + version
+	}
+	resp, err := client.Get(url)
 	if err != nil {
-		return []string{}
+		return nil, "", err
 	}
 
 	var bytes []byte
 	bytes, err = ioutil.ReadAll(resp.Body)
 	body := string(bytes)
 	resp.Body.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("reachable hosts: %s", resp.Status)
+	}
 
 	trimmed := strings.TrimSpace(body)
 	nodes := strings.Split(trimmed, "\n")
 
 
-	for i, v := range nodes {
-		if v == "compute-1-4" {
-			nodes = remove2(nodes, i)
-		}
-		if v == "compute-2-20" {
-			nodes = remove2(nodes, i)
+	var hosts []string
+	for _, v := range nodes {
+		if !contains(excludedHosts, v) {
+			hosts = append(hosts, v)
 		}
 	}
 	//return nodes[14:24]
-	return nodes
+	return hosts, resp.Header.Get(reachableVersionHeader), nil
 }
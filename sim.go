@@ -0,0 +1,99 @@
+package main
+
+import (
+	"./rocks"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var numNodes int
+var wormgatePort string
+var segmentPort string
+var maxRunTime time.Duration
+
+// Start a simulated cluster: a number of worm gates on this machine, each
+// believing it runs on its own compute-x-y node. Every process started in
+// the simulated cluster gets WORM_SIM in its environment, which makes the
+// rocks package list the simulated nodes and map each node name to its own
+// ports on 127.0.0.1.
+//
+// Arguments after the flags are passed on to every worm gate.
+func main() {
+	flag.IntVar(&numNodes, "n", 9, "number of simulated nodes (at most 180)")
+	flag.StringVar(&wormgatePort, "wp", ":8181", "base wormgate port (prefix with colon)")
+	flag.StringVar(&segmentPort, "sp", ":8182", "base segment port, only used for the hints")
+	flag.DurationVar(&maxRunTime, "maxrun", time.Minute*10, "max time to run (in case you forget to shut down)")
+	flag.Parse()
+
+	log.SetPrefix("sim: ")
+
+	if numNodes < 1 || numNodes > 180 {
+		log.Fatalf("Number of nodes must be between 1 and 180, not %d", numNodes)
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	wormgate := filepath.Join(filepath.Dir(binary), "wormgate")
+
+	os.Setenv(rocks.SimEnv, fmt.Sprint(numNodes))
+
+	var gates []*exec.Cmd
+	for _, node := range rocks.SimNodes(numNodes) {
+		args := append([]string{"-wp", wormgatePort, "-maxrun", maxRunTime.String()}, flag.Args()...)
+		cmd := exec.Command(wormgate, args...)
+		cmd.Env = append(os.Environ(), rocks.HostnameEnv+"="+node)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Start()
+		if err != nil {
+			log.Printf("Error starting wormgate for %s: %s", node, err)
+			continue
+		}
+		log.Printf("Started wormgate %s on %s (pid %d)",
+			node, rocks.Addr(node, wormgatePort), cmd.Process.Pid)
+		gates = append(gates, cmd)
+	}
+
+	printHints(os.Stderr)
+
+	// Run until interrupted or maxrun, then take the gates down with us
+	interrupt := make(chan os.Signal, 2)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-interrupt:
+		log.Printf("Got signal %s", sig)
+	case <-time.After(maxRunTime):
+		log.Printf("maxrun timeout: %s", maxRunTime)
+	}
+
+	log.Print("Shutting down wormgates")
+	for _, cmd := range gates {
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	// The worm gates take their segments down with them
+	for _, cmd := range gates {
+		cmd.Wait()
+	}
+}
+
+func printHints(w io.Writer) {
+	env := fmt.Sprintf("%s=%d", rocks.SimEnv, numNodes)
+	first := rocks.SimNodes(1)[0]
+	hint := []string{
+		"Simulated cluster is up. In another terminal:",
+		fmt.Sprintf("    %s ./visualize -wp %s -sp %s", env, wormgatePort, segmentPort),
+		fmt.Sprintf("    %s ./segment spread -wp %s -sp %s -host %s", env, wormgatePort, segmentPort, first),
+	}
+	fmt.Fprintln(w, strings.Join(hint, "\n"))
+}
@@ -0,0 +1,192 @@
+// Package split decides how many segments each side of a split worm keeps.
+//
+// While the network is partitioned, the leader on every side sees only the
+// segments on its own side, and would grow that side to the full target. When
+// the partition heals, the worm then has several times the target, and has to
+// kill the excess. A Tracker notices when the reachable hosts are fewer than
+// all hosts, and gives each side a goal according to a policy:
+//
+//   - majority: the side with more than half of the hosts keeps the full
+//     target. The other sides hold the segments they have, spawning none. If
+//     the hosts are split in half exactly, the side with the first host wins.
+//   - proportional: every side keeps its share of the target, by its share of
+//     the hosts, and at least one segment.
+//   - full: every side keeps the full target, as if it was the whole worm.
+//
+// Whenever the reachable hosts change, the worm holds still for a while: the
+// membership needs time to find the segments that went out of or came back
+// into reach, and the sides need time to agree on a single leader. Only then
+// is the goal worth acting on, and the leader kills no more than the excess.
+package split
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policy says how many segments the sides of a split worm keep.
+type Policy int
+
+const (
+	Majority Policy = iota
+	Proportional
+	Full
+)
+
+var policyNames = []string{"majority", "proportional", "full"}
+
+func (p Policy) String() string {
+	if p < 0 || int(p) >= len(policyNames) {
+		return fmt.Sprintf("Policy(%d)", int(p))
+	}
+	return policyNames[p]
+}
+
+// ParsePolicy finds a policy by name.
+func ParsePolicy(s string) (Policy, error) {
+	for i, name := range policyNames {
+		if s == name {
+			return Policy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown partition policy %q (want majority, proportional or full)", s)
+}
+
+// Tracker follows the reachable hosts of one segment.
+type Tracker struct {
+	mu sync.Mutex
+
+	policy    Policy
+	settle    time.Duration
+	all       []string // sorted
+	reachable []string
+	changed   time.Time
+}
+
+// New creates a tracker for a worm that may run on all hosts. The worm holds
+// still for settle after the reachable hosts change.
+func New(policy Policy, settle time.Duration, all []string, now time.Time) *Tracker {
+	sorted := append([]string(nil), all...)
+	sort.Strings(sorted)
+	return &Tracker{
+		policy:    policy,
+		settle:    settle,
+		all:       sorted,
+		reachable: sorted,
+		changed:   now,
+	}
+}
+
+// Update tells the tracker which hosts are reachable now. It reports whether
+// the worm split or healed.
+func (t *Tracker) Update(reachable []string, now time.Time) (splitChanged bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reachable = t.known(reachable)
+	if sameHosts(reachable, t.reachable) {
+		return false
+	}
+	wasSplit := t.split()
+	t.reachable = reachable
+	t.changed = now
+	return wasSplit != t.split()
+}
+
+// Split reports whether some hosts are out of reach.
+func (t *Tracker) Split() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.split()
+}
+
+// Size returns how many hosts this side of the worm has, and the worm as a
+// whole.
+func (t *Tracker) Size() (side, all int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.reachable), len(t.all)
+}
+
+// Goal returns how many segments this side of the worm should have, given
+// the target for the whole worm and the segments alive on this side. Until
+// the worm has settled, the goal is what it has.
+func (t *Tracker) Goal(target, alive int, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.changed) < t.settle {
+		return alive
+	}
+	if !t.split() || target <= 0 {
+		return target
+	}
+
+	switch t.policy {
+	case Majority:
+		if t.majority() {
+			return target
+		}
+		if alive < target {
+			return alive
+		}
+		return target
+	case Proportional:
+		share := (target*len(t.reachable) + len(t.all)/2) / len(t.all)
+		if share < 1 {
+			share = 1
+		}
+		return share
+	}
+	return target
+}
+
+func (t *Tracker) split() bool {
+	return len(t.reachable) < len(t.all)
+}
+
+// majority reports whether this side has more than half of the hosts, or
+// half of them and the first one
+func (t *Tracker) majority() bool {
+	n, total := len(t.reachable), len(t.all)
+	if 2*n != total {
+		return 2*n > total
+	}
+	return contains(t.reachable, t.all[0])
+}
+
+// known keeps the hosts that the worm may run on, sorted, so that hosts the
+// tracker doesn't know of don't count towards a side
+func (t *Tracker) known(hosts []string) []string {
+	var kept []string
+	for _, host := range hosts {
+		if contains(t.all, host) && !contains(kept, host) {
+			kept = append(kept, host)
+		}
+	}
+	sort.Strings(kept)
+	return kept
+}
+
+func sameHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
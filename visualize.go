@@ -1,8 +1,15 @@
 package main
 
 import (
+	"./auth"
+	"./dashboard"
+	"./metrics"
+	"./recording"
+	"./report"
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"flag"
 	"io"
@@ -13,6 +20,8 @@ import (
 	"os"
 	"os/signal"
 	"./rocks"
+	"./scenario"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -31,6 +40,7 @@ var maxRunTime time.Duration
 
 var wormgatePort string
 var segmentPort string
+var wormId string
 
 type status struct {
 	wormgate  bool
@@ -38,6 +48,8 @@ type status struct {
 	err       bool
 	rateGuess float32
 	rateErr   error
+	// From GET /status, if the segment has it
+	detail *report.Status
 }
 
 var statusMap struct {
@@ -47,7 +59,62 @@ var statusMap struct {
 
 var killRate int32;
 var targetSegments int32;
-var partitionScheme int32;
+var partitionScheme atomic.Value // number or name, as a string
+
+// Picks the segments to kill and to command. Seeded with -seed, so that
+// scenarios can be repeated.
+var random struct {
+	sync.Mutex
+	*rand.Rand
+}
+
+var exitReason = make(chan string, 1)
+
+// Records the session with -record, if set
+var recorder *recording.Recorder
+
+// Segment log shown under the grid, chosen with the l command
+const logTailLines = 10
+const logTailWidth = 150
+
+var logTail struct {
+	sync.Mutex
+	node   string
+	lines  []string
+	cancel context.CancelFunc
+}
+
+// Time shown under the grid. Replays show the recorded time.
+var displayClock = time.Now
+
+var (
+	kills = metrics.NewCounter("visualizer_kills_total",
+		"Kill commands sent to worm gates.")
+	_ = metrics.NewGaugeFunc("visualizer_segments",
+		"Nodes where a segment answers.",
+		func() float64 { return float64(countNodes(func(s status) bool { return s.segment })) })
+	_ = metrics.NewGaugeFunc("visualizer_wormgates",
+		"Nodes where a worm gate answers.",
+		func() float64 { return float64(countNodes(func(s status) bool { return s.wormgate })) })
+	_ = metrics.NewGaugeFunc("visualizer_target_segments",
+		"Target number of segments.",
+		func() float64 { return float64(atomic.LoadInt32(&targetSegments)) })
+	_ = metrics.NewGaugeFunc("visualizer_kill_rate",
+		"Kill rate setting, in kills per second.",
+		func() float64 { return float64(atomic.LoadInt32(&killRate)) })
+)
+
+func countNodes(match func(status) bool) int {
+	statusMap.RLock()
+	defer statusMap.RUnlock()
+	n := 0
+	for _, status := range statusMap.m {
+		if match(status) {
+			n++
+		}
+	}
+	return n
+}
 
 // Use separate clients for wormgates vs segments
 //
@@ -60,19 +127,69 @@ var partitionScheme int32;
 var wormgateClient *http.Client
 var segmentClient *http.Client
 
+// Shared secret that signs our commands to worm gates and segments
+var secret []byte
+
 func createClient() *http.Client {
 	return &http.Client{
-		Transport: &http.Transport{},
+		Transport: &auth.Transport{Secret: secret, Base: &http.Transport{}},
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+
 	flag.StringVar(&wormgatePort, "wp", ":8181", "wormgate port (prefix with colon)")
 	flag.StringVar(&segmentPort, "sp", ":8182", "segment port (prefix with colon)")
+	flag.StringVar(&wormId, "id", "", "id of the worm to watch, if the worm gates run several (default the segment port)")
 	flag.DurationVar(&maxRunTime, "maxrun", time.Minute*10, "maxtime to run (in case you forget to shut down)")
+	var secretFile = flag.String("secretfile", "", "shared secret for control requests, generated if the file doesn't exist")
+	var scenarioFile = flag.String("scenario", "", "file with a timed script of commands to run")
+	var seed = flag.Int64("seed", 0, "random seed for picking segments (0 for a random one)")
+	var dashboardAddr = flag.String("http", "", "serve a web dashboard on this address, e.g. localhost:9000")
+	var recordFile = flag.String("record", "", "record the session to this file, for visualize replay")
+	var nodesSpec string
+	rocks.NodesFlag(flag.CommandLine, &nodesSpec)
 	flag.Parse()
+	if wormId == "" {
+		wormId = segmentPort
+	}
 
-	nodes := rocks.ListNodes()
+	if err := rocks.Use(nodesSpec, wormgatePort); err != nil {
+		log.Fatal(err)
+	}
+
+	if *secretFile != "" {
+		var err error
+		secret, err = auth.CreateSecret(*secretFile)
+		if err != nil {
+			log.Panic("Could not load or create secret ", err)
+		}
+		log.Printf("Signing commands with secret from %s", *secretFile)
+	}
+
+	var scen scenario.Scenario
+	if *scenarioFile != "" {
+		var err error
+		scen, err = scenario.Load(*scenarioFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("Random seed: %d", *seed)
+	random.Rand = rand.New(rand.NewSource(*seed))
+
+	nodes, err := rocks.ListNodes()
+	if err != nil {
+		log.Panic("Error getting available nodes ", err)
+	}
 
 	statusMap.m = make(map[string]status)
 	for _, node := range nodes {
@@ -80,6 +197,23 @@ func main() {
 	}
 
 	targetSegments = 5
+	partitionScheme.Store("0")
+
+	if *recordFile != "" {
+		var err error
+		recorder, err = recording.Create(*recordFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Recording session to %s", *recordFile)
+		recorder.Record(recording.Event{
+			Kind:   recording.Start,
+			Nodes:  nodes,
+			Target: targetSegments,
+			Rate:   killRate,
+			Scheme: "0",
+		})
+	}
 
 	segmentClient = createClient()
 	wormgateClient = createClient()
@@ -88,7 +222,6 @@ func main() {
 	interrupt := make(chan os.Signal, 2)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
-	exitReason := make(chan string, 1)
 	go func() {
 		//<-interrupt
 		time.Sleep(maxRunTime)
@@ -106,6 +239,7 @@ func main() {
 		fmt.Print(ansi_clear_to_end)
 		fmt.Println()
 		log.Print("Shutting down")
+		recorder.Close()
 		os.Exit(0)
 	}()
 
@@ -120,6 +254,14 @@ func main() {
 	// Start random node killer
 	go killNodesForever()
 
+	if scen != nil {
+		go runScenario(scen)
+	}
+
+	if *dashboardAddr != "" {
+		go serveDashboard(*dashboardAddr)
+	}
+
 	// Loop display forever
 	for {
 		printNodeGrid()
@@ -127,13 +269,108 @@ func main() {
 	}
 }
 
+// replay plays a recorded session back on the grid
+func replay(args []string) {
+	var replayMode = flag.NewFlagSet("replay", flag.ExitOnError)
+	var speed = replayMode.Float64("speed", 1, "playback speed (2 plays twice as fast)")
+	replayMode.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: visualize replay [-speed x] <recording>")
+		replayMode.PrintDefaults()
+	}
+	replayMode.Parse(args)
+	if replayMode.NArg() != 1 || *speed <= 0 {
+		replayMode.Usage()
+		os.Exit(2)
+	}
+
+	events, err := recording.Load(replayMode.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	start := events[0]
+	statusMap.m = make(map[string]status)
+	for _, node := range start.Nodes {
+		statusMap.m[node] = status{}
+	}
+	targetSegments = start.Target
+	killRate = start.Rate
+	partitionScheme.Store(start.Scheme)
+
+	replayStart := time.Now()
+	displayClock = func() time.Time {
+		return start.Time.Add(time.Duration(float64(time.Since(replayStart)) * *speed))
+	}
+	last := events[len(events)-1].Time.Sub(start.Time)
+	log.Printf("Replaying %d events over %s at %gx speed", len(events), last, *speed)
+
+	done := make(chan bool)
+	go func() {
+		recording.Replay(events, *speed, replayEvent)
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			// Leave the final grid on screen
+			fmt.Print(ansi_down_lines(printNodeGrid()))
+			log.Print("Replay done")
+			return
+		case <-time.After(refreshRate):
+			printNodeGrid()
+		}
+	}
+}
+
+var errNoGuess = errors.New("no rate guess")
+
+func replayEvent(e recording.Event) {
+	switch e.Kind {
+	case recording.Status:
+		s := status{e.Wormgate, e.Segment, e.Err, e.RateGuess, nil, nil}
+		if !e.RateOk {
+			s.rateErr = errNoGuess
+		}
+		statusMap.Lock()
+		statusMap.m[e.Node] = s
+		statusMap.Unlock()
+	case recording.Command:
+		log.Printf("Replay: %s %s", e.Command, e.Value)
+		var n int32
+		fmt.Sscan(e.Value, &n)
+		switch e.Command {
+		case recording.TargetSegments:
+			atomic.StoreInt32(&targetSegments, n)
+		case recording.KillRate:
+			atomic.StoreInt32(&killRate, n)
+		case recording.PartitionScheme:
+			partitionScheme.Store(e.Value)
+		}
+	case recording.Kill:
+		log.Printf("Replay: killing segment on %s", e.Node)
+	}
+}
+
 func pollNodeForever(node string) {
 	log.Printf("Starting poll routine for %s", node)
 	for {
 		s := pollNode(node)
 		statusMap.Lock()
+		prev := statusMap.m[node]
 		statusMap.m[node] = s
 		statusMap.Unlock()
+		if !s.same(prev) {
+			recorder.Record(recording.Event{
+				Kind:      recording.Status,
+				Node:      node,
+				Wormgate:  s.wormgate,
+				Segment:   s.segment,
+				Err:       s.err,
+				RateGuess: s.rateGuess,
+				RateOk:    s.rateErr == nil,
+			})
+		}
 		if s.err {
 			time.Sleep(pollErrWait)
 		} else {
@@ -142,32 +379,51 @@ func pollNodeForever(node string) {
 	}
 }
 
+// same tells if two statuses look the same on the grid
+func (s status) same(o status) bool {
+	return s.wormgate == o.wormgate && s.segment == o.segment &&
+		s.err == o.err && s.rateGuess == o.rateGuess &&
+		(s.rateErr == nil) == (o.rateErr == nil)
+}
+
 func pollNode(host string) status {
-	wormgateUrl := fmt.Sprintf("http://%s%s/", host, wormgatePort)
-	segmentUrl := fmt.Sprintf("http://%s%s/", host, segmentPort)
+	wormgateUrl := fmt.Sprintf("http://%s/", rocks.Addr(host, wormgatePort))
+	segmentUrl := fmt.Sprintf("http://%s/", rocks.Addr(host, segmentPort))
+	statusUrl := fmt.Sprintf("http://%s/status", rocks.Addr(host, segmentPort))
 
 	wormgate, _, wgerr := httpGetOk(wormgateClient, wormgateUrl)
 	if wgerr != nil {
-		return status{false, false, true, 0, nil}
+		return status{false, false, true, 0, nil, nil}
+	}
+	// Prefer the JSON status. Segments without it answer with the kill
+	// rate guess, either on any path or only on /.
+	segment, segBody, segErr := httpGetOk(segmentClient, statusUrl)
+	if segErr == nil && !segment && segBody != "" {
+		segment, segBody, segErr = httpGetOk(segmentClient, segmentUrl)
 	}
-	segment, segBody, segErr := httpGetOk(segmentClient, segmentUrl)
 
 	if segErr != nil {
-		return status{false, false, true, 0, nil}
+		return status{false, false, true, 0, nil, nil}
 	}
 
 	var rateGuess float32 = 0
 	var rateErr error = nil
+	var detail *report.Status
 	if segment {
-		var pc int
-		pc, rateErr = fmt.Sscanf(segBody, "%f", &rateGuess)
-		if pc != 1 || rateErr != nil {
-			log.Printf("Error parsing from %s (%d items): %s", host, pc, rateErr)
-			log.Printf("Response %s: %s", host, segBody)
+		if s, err := report.Decode(strings.NewReader(segBody)); err == nil {
+			detail = &s
+			rateGuess = float32(s.KillRate)
+		} else {
+			var pc int
+			pc, rateErr = fmt.Sscanf(segBody, "%f", &rateGuess)
+			if pc != 1 || rateErr != nil {
+				log.Printf("Error parsing from %s (%d items): %s", host, pc, rateErr)
+				log.Printf("Response %s: %s", host, segBody)
+			}
 		}
 	}
 
-	return status{wormgate, segment, false, rateGuess, rateErr}
+	return status{wormgate, segment, false, rateGuess, rateErr, detail}
 }
 
 func httpGetOk(client *http.Client, url string) (bool, string, error) {
@@ -194,76 +450,261 @@ func inputHandler() {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
-		input, _ := reader.ReadString('\n')
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			// No terminal, e.g. when running a scenario in the background
+			log.Printf("Stopped reading input: %s", err)
+			return
+		}
 		log.Printf("Input: %s", input)
 
-		kr := atomic.LoadInt32(&killRate)
-		ts := atomic.LoadInt32(&targetSegments)
-		ps := atomic.LoadInt32(&partitionScheme)
-		shutdown := false
-
-		for _, ch := range input {
-			switch ch {
-			case 'k':
-				kr += 1
-			case 'K':
-				kr += 10
-			case 'j':
-				kr -= 1
-			case 'J':
-				kr -= 10
-			case '=': fallthrough
-			case '+':
-				ts += 1
-			case '_': fallthrough
-			case '-':
-				ts -= 1
-			case 's':
-				shutdown = true
-			case '0':
-				ps = 0
-			case '1':
-				ps = 1
-			}
-		}
-		if kr < 0 {
-			kr = 0
+		fmt.Print(ansi_clear_to_end)
+		handleKeys(input)
+	}
+}
+
+// handleKeys runs a series of command characters, from the keyboard or from
+// the dashboard. `l <node>` tails the segment log of a node instead, and
+// `l` alone stops.
+func handleKeys(input string) {
+	if fields := strings.Fields(input); len(fields) > 0 && fields[0] == "l" {
+		node := ""
+		if len(fields) > 1 {
+			node = fields[1]
 		}
-		if ts < 1 {
-			ts = 1
+		followLog(node)
+		return
+	}
+
+	kr := atomic.LoadInt32(&killRate)
+	ts := atomic.LoadInt32(&targetSegments)
+	ps := partitionScheme.Load().(string)
+	shutdown := false
+
+	for _, ch := range input {
+		switch ch {
+		case 'k':
+			kr += 1
+		case 'K':
+			kr += 10
+		case 'j':
+			kr -= 1
+		case 'J':
+			kr -= 10
+		case '=': fallthrough
+		case '+':
+			ts += 1
+		case '_': fallthrough
+		case '-':
+			ts -= 1
+		case 's':
+			shutdown = true
+		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			ps = string(ch)
 		}
+	}
+	if kr < 0 {
+		kr = 0
+	}
+	if ts < 1 {
+		ts = 1
+	}
 
-		fmt.Print(ansi_clear_to_end)
+	setTargetSegments(ts)
+	setKillRate(kr)
+	setPartitionScheme(ps)
+	if shutdown {
+		shutdownWorm()
+	}
+}
 
-		prevts := atomic.SwapInt32(&targetSegments, ts)
-		log.Printf("Target segments: %d -> %d", prevts, ts)
+func serveDashboard(addr string) {
+	log.Printf("Serving dashboard on http://%s/", addr)
+	mux := http.NewServeMux()
+	mux.Handle("/", dashboard.Handler(dashboard.Controls{
+		Snapshot:  snapshot,
+		Keys:      handleKeys,
+		Partition: setPartitionScheme,
+		Token:     dashboard.Token(secret),
+	}, refreshRate))
+	mux.HandleFunc("/metrics", metrics.Handler)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Panic(err)
+	}
+}
 
-		prevkr := atomic.SwapInt32(&killRate, kr)
-		log.Printf("Kill rate: %d -> %d", prevkr, kr)
+// snapshot collects what printNodeGrid shows for the dashboard
+func snapshot() dashboard.Snapshot {
+	snap := dashboard.Snapshot{
+		Time:            time.Now(),
+		TargetSegments:  atomic.LoadInt32(&targetSegments),
+		KillRate:        atomic.LoadInt32(&killRate),
+		PartitionScheme: partitionScheme.Load().(string),
+	}
 
-		prevps := atomic.SwapInt32(&partitionScheme, ps)
-		log.Printf("Partition scheme: %d -> %d", prevps, ps)
+	var rateGuesses []float32
+	statusMap.RLock()
+	for node, status := range statusMap.m {
+		reporting := status.segment && !status.err && status.rateErr == nil
+		snap.Nodes = append(snap.Nodes, dashboard.Node{
+			Name:      node,
+			Wormgate:  status.wormgate,
+			Segment:   status.segment,
+			Err:       status.err,
+			RateGuess: status.rateGuess,
+			Reporting: reporting,
+			Status:    status.detail,
+		})
+		if status.segment {
+			snap.Segments++
+		}
+		if reporting {
+			rateGuesses = append(rateGuesses, status.rateGuess)
+		}
+	}
+	statusMap.RUnlock()
+
+	snap.Reporting = len(rateGuesses)
+	if len(rateGuesses) > 0 {
+		snap.AvgGuess = mean(rateGuesses)
+	}
+	return snap
+}
 
-		if ps!=prevps {
-			for _,target := range allWormgateNodes() {
-				doPartitionSchemePost(target,ps)
+// followLog streams the segment log of node from its worm gate into
+// logTail, replacing the log followed before
+func followLog(node string) {
+	logTail.Lock()
+	defer logTail.Unlock()
+	if logTail.cancel != nil {
+		logTail.cancel()
+		logTail.cancel = nil
+	}
+	logTail.node = node
+	logTail.lines = nil
+	if node == "" {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	logTail.cancel = cancel
+	url := fmt.Sprintf("http://%s/logs?id=%s&follow=1&lines=%d",
+		rocks.Addr(node, wormgatePort), wormId, logTailLines)
+	log.Printf("Following segment log of %s", node)
+	go func() {
+		for ctx.Err() == nil {
+			tailLog(ctx, node, url)
+			// The segment ended or there was none, wait for the next
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
 			}
 		}
+	}()
+}
 
-		if ts!=prevts {
-			for _,target := range randomSegment() {
-				doTargetSegmentsPost(target,ts)
-			}
+func tailLog(ctx context.Context, node, url string) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := wormgateClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return
+	}
+
+	// We asked for the last lines again, so start over
+	logTail.Lock()
+	if logTail.node == node {
+		logTail.lines = nil
+	}
+	logTail.Unlock()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) > logTailWidth {
+			line = line[:logTailWidth]
+		}
+		logTail.Lock()
+		if logTail.node != node {
+			logTail.Unlock()
+			return
+		}
+		logTail.lines = append(logTail.lines, line)
+		if len(logTail.lines) > logTailLines {
+			logTail.lines = logTail.lines[1:]
 		}
+		logTail.Unlock()
+	}
+}
 
-		if shutdown {
-			for _,target := range randomSegment() {
-				doWormShutdownPost(target)
-			}
+func runScenario(scen scenario.Scenario) {
+	log.Printf("Running scenario of %d steps", len(scen))
+	scen.Run(time.Now(), func(step scenario.Step) {
+		log.Printf("Scenario line %d: %s", step.Line, step)
+		switch step.Command {
+		case scenario.Target:
+			setTargetSegments(step.Int())
+		case scenario.KillRate:
+			setKillRate(step.Int())
+		case scenario.Partition:
+			setPartitionScheme(step.Arg)
+		case scenario.Shutdown:
+			shutdownWorm()
+		case scenario.Quit:
+			exitReason <- "scenario finished"
+		}
+	})
+	log.Print("Scenario done")
+}
+
+func setTargetSegments(ts int32) {
+	prevts := atomic.SwapInt32(&targetSegments, ts)
+	log.Printf("Target segments: %d -> %d", prevts, ts)
+
+	if ts!=prevts {
+		recordCommand(recording.TargetSegments, fmt.Sprint(ts))
+		for _,target := range randomSegment() {
+			doTargetSegmentsPost(target,ts)
 		}
 	}
 }
 
+func setKillRate(kr int32) {
+	prevkr := atomic.SwapInt32(&killRate, kr)
+	log.Printf("Kill rate: %d -> %d", prevkr, kr)
+
+	if kr!=prevkr {
+		recordCommand(recording.KillRate, fmt.Sprint(kr))
+	}
+}
+
+func setPartitionScheme(ps string) {
+	prevps := partitionScheme.Swap(ps).(string)
+	log.Printf("Partition scheme: %s -> %s", prevps, ps)
+
+	if ps!=prevps {
+		recordCommand(recording.PartitionScheme, ps)
+		for _,target := range allWormgateNodes() {
+			doPartitionSchemePost(target,ps)
+		}
+	}
+}
+
+func shutdownWorm() {
+	recordCommand(recording.Shutdown, "")
+	for _,target := range randomSegment() {
+		doWormShutdownPost(target)
+	}
+}
+
 func killNodesForever() {
 	for {
 		kr := atomic.LoadInt32(&killRate)
@@ -288,7 +729,11 @@ func randomSegment() []string {
 	}
 	statusMap.RUnlock()
 	if len(segmentNodes) > 0 {
-		ri := rand.Intn(len(segmentNodes))
+		// Map order is random, so sort to make the seed count
+		sort.Strings(segmentNodes)
+		random.Lock()
+		ri := random.Intn(len(segmentNodes))
+		random.Unlock()
 		return segmentNodes[ri:ri+1]
 	} else {
 		return []string{}
@@ -309,13 +754,24 @@ func allWormgateNodes() []string {
 
 func killRandomNode() {
 	for _,target := range randomSegment() {
-		doKillPost(target)
+		// Don't wait, worm gates with a grace period take a while
+		go doKillPost(target)
 	}
 }
 
+func recordCommand(command, value string) {
+	recorder.Record(recording.Event{
+		Kind:    recording.Command,
+		Command: command,
+		Value:   value,
+	})
+}
+
 func doKillPost(node string) error {
 	log.Printf("Killing segment on %s", node)
-	url := fmt.Sprintf("http://%s%s/killsegment", node, wormgatePort)
+	recorder.Record(recording.Event{Kind: recording.Kill, Node: node})
+	kills.Inc()
+	url := fmt.Sprintf("http://%s/killsegment?id=%s", rocks.Addr(node, wormgatePort), wormId)
 	resp, err := wormgateClient.PostForm(url, nil)
 	if err != nil && !strings.Contains(fmt.Sprint(err), "refused") {
 		log.Printf("Error killing %s: %s", node, err)
@@ -327,16 +783,19 @@ func doKillPost(node string) error {
 	return err
 }
 
-func doPartitionSchemePost(node string, newps int32) error {
-	log.Printf("Posting partitionScheme: %d -> %s", newps, node)
+func doPartitionSchemePost(node string, newps string) error {
+	log.Printf("Posting partitionScheme: %s -> %s", newps, node)
 
-	url := fmt.Sprintf("http://%s%s/partitionscheme", node, wormgatePort)
-	postBody := strings.NewReader(fmt.Sprint(newps))
+	url := fmt.Sprintf("http://%s/partitionscheme", rocks.Addr(node, wormgatePort))
+	postBody := strings.NewReader(newps)
 
 	resp, err := wormgateClient.Post(url, "text/plain", postBody)
 	if err != nil && !strings.Contains(fmt.Sprint(err), "refused") {
 		log.Printf("Error posting partitionScheme %s: %s", node, err)
 	}
+	if err == nil && resp.StatusCode != 200 {
+		log.Printf("Partition scheme %s refused by %s: %s", newps, node, resp.Status)
+	}
 	if err == nil {
 		io.Copy(ioutil.Discard, resp.Body)
 		resp.Body.Close()
@@ -347,7 +806,7 @@ func doPartitionSchemePost(node string, newps int32) error {
 func doTargetSegmentsPost(node string, newts int32) error {
 	log.Printf("Posting targetSegments: %d -> %s", newts, node)
 
-	url := fmt.Sprintf("http://%s%s/targetsegments", node, segmentPort)
+	url := fmt.Sprintf("http://%s/targetsegments", rocks.Addr(node, segmentPort))
 	postBody := strings.NewReader(fmt.Sprint(newts))
 
 	resp, err := segmentClient.Post(url, "text/plain", postBody)
@@ -364,15 +823,18 @@ func doTargetSegmentsPost(node string, newts int32) error {
 func doWormShutdownPost(node string) error {
 	log.Printf("Posting shutdown to %s", node)
 
-	url := fmt.Sprintf("http://%s%s/shutdown", node, segmentPort)
+	url := fmt.Sprintf("http://%s/shutdown", rocks.Addr(node, segmentPort))
 
 	resp, err := segmentClient.PostForm(url, nil)
 	if err != nil && !strings.Contains(fmt.Sprint(err), "refused") {
 		log.Printf("Error posting targetSegments %s: %s", node, err)
 	}
 	if err == nil {
-		io.Copy(ioutil.Discard, resp.Body)
+		// The segment sums up what the worm gates did last
+		body, _ := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		log.Print(lines[len(lines)-1])
 	}
 	return err
 }
@@ -381,6 +843,7 @@ const ansi_bold = "\033[1m"
 const ansi_reset = "\033[0m"
 const ansi_reverse = "\033[30;47m"
 const ansi_red_bg = "\033[30;41m"
+const ansi_underline = "\033[4m"
 const ansi_clear_to_end = "\033[0J"
 
 func ansi_down_lines(n int) string {
@@ -390,11 +853,16 @@ func ansi_up_lines(n int) string {
 	return fmt.Sprintf("\033[%dF", n)
 }
 
-func printNodeGrid() {
+// printNodeGrid draws the grid and moves the cursor back up to where it
+// started. It returns the number of lines drawn.
+func printNodeGrid() int {
 	statusMap.RLock()
 
 	gridBuf := bytes.NewBuffer(nil)
 	rateGuesses := make([]float32, 0, len(statusMap.m))
+	// What the segments with GET /status say
+	leaders := make(map[string]int)
+	versions := make(map[string]int)
 
 	fmt.Fprint(gridBuf, ansi_clear_to_end)
 	fmt.Fprintln(gridBuf)
@@ -403,13 +871,15 @@ func printNodeGrid() {
 	fmt.Fprint(gridBuf, "node,  ")
 	fmt.Fprint(gridBuf, ansi_bold, "wormgate", ansi_reset, ",  ")
 	fmt.Fprint(gridBuf, ansi_reverse, "segment", ansi_reset, ",  ")
-	fmt.Fprint(gridBuf, ansi_red_bg, "error", ansi_reset)
+	fmt.Fprint(gridBuf, ansi_red_bg, "error", ansi_reset, ",  ")
+	fmt.Fprint(gridBuf, ansi_underline, "leader", ansi_reset)
 	fmt.Fprintln(gridBuf)
 	fmt.Fprint(gridBuf, "Keys  :")
 	fmt.Fprint(gridBuf, "  kK/jJ kill rate,")
 	fmt.Fprint(gridBuf, "  +/- segments,")
 	fmt.Fprint(gridBuf, "  0-9 partition,")
 	fmt.Fprint(gridBuf, "  s worm shutdown,")
+	fmt.Fprint(gridBuf, "  l <node> log,")
 	fmt.Fprint(gridBuf, "  Ctrl-C quit")
 
 	for x := minx; x <= maxx; x++ {
@@ -443,6 +913,18 @@ func printNodeGrid() {
 					rateGuesses = append(rateGuesses,
 						status.rateGuess)
 				}
+				if status.segment && status.detail != nil {
+					if status.detail.Leader == node {
+						fmt.Fprint(gridBuf, ansi_underline)
+					}
+					leader := "none"
+					if status.detail.Leader != "" {
+						leader = fmt.Sprintf("%s term %d",
+							status.detail.Leader, status.detail.Term)
+					}
+					leaders[leader]++
+					versions[status.detail.Version]++
+				}
 			}
 			fmt.Fprint(gridBuf, char)
 			fmt.Fprint(gridBuf, ansi_reset)
@@ -456,13 +938,48 @@ func printNodeGrid() {
 
 	kr := atomic.LoadInt32(&killRate)
 	fmt.Fprintf(gridBuf, "Kill rate: %d/sec\n", kr)
+	fmt.Fprintf(gridBuf, "Partition scheme: %s\n", partitionScheme.Load())
 	fmt.Fprintf(gridBuf, "Avg guess: %.1f/sec (%d segments reporting)\n",
 		mean(rateGuesses), len(rateGuesses))
+	if len(leaders) > 0 {
+		fmt.Fprintf(gridBuf, "Leader: %s\n", countsString(leaders))
+		fmt.Fprintf(gridBuf, "Versions: %s\n", countsString(versions))
+	}
 
-	fmt.Fprintln(gridBuf, time.Now().Format(time.StampMilli))
+	logTail.Lock()
+	if logTail.node != "" {
+		fmt.Fprintf(gridBuf, "Segment log of %s (l to close):\n", logTail.node)
+		for _, line := range logTail.lines {
+			fmt.Fprintln(gridBuf, "  "+line)
+		}
+	}
+	logTail.Unlock()
+
+	fmt.Fprintln(gridBuf, displayClock().Format(time.StampMilli))
 	var gridLines = bytes.Count(gridBuf.Bytes(), []byte("\n"))
 	fmt.Fprint(gridBuf, ansi_up_lines(gridLines))
 	io.Copy(os.Stdout, gridBuf)
+	return gridLines
+}
+
+// countsString lists what segments said, most common first, with how many
+// said it: "a (3), b (1)"
+func countsString(counts map[string]int) string {
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s (%d)", k, counts[k]))
+	}
+	return strings.Join(parts, ", ")
 }
 
 func mean(floats []float32) float32 {
@@ -1,20 +1,37 @@
 package main
 
 import (
+	"./auth"
+	"./metrics"
+	"./partition"
+	"./payload"
+	"./proxy"
 	"./rocks"
+	"./sandbox"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -24,41 +41,250 @@ var wormgatePort string
 
 var path string
 
+// Extraction directories start with this, so that worm gates sharing the path
+// only clean up after themselves
+var dirPrefix string
+
+// Limits on what segments take up on disk, in bytes. Zero means no limit.
+var maxPayload int64
+var quota int64
+
+// Only segments signed with the matching key are run, if set
+var publicKey ed25519.PublicKey
+
+// Shared secret for control requests, passed on to the segments
+var secret []byte
+
 var hostname string
 var allHosts []string
-var partitionScheme int32
 
-var runningSegment struct {
+// Partition schemes we know of, and the active one (a *partition.Scheme)
+var partitions = partition.Builtin()
+var partitionScheme atomic.Value
+
+// A segment we run for a worm. The process is nil while the segment is
+// still being received. done is closed when the process has ended.
+type runningSegment struct {
+	port  string
+	epoch int64
+	p     *os.Process
+	rec   *segmentRecord
+	done  chan struct{}
+}
+
+// The segments we run, by worm ID
+var runningSegments = struct {
 	sync.RWMutex
-	p *os.Process
+	m map[string]*runningSegment
+}{m: make(map[string]*runningSegment)}
+var maxSegments int
+
+// Worm IDs go on the segment command line and in file names, keep them tame
+var wormIdPattern = regexp.MustCompile(`^[A-Za-z0-9:._-]{1,64}$`)
+
+// What happened to the segments we ran, oldest first, for GET /segments
+var segmentHistory struct {
+	sync.Mutex
+	records []*segmentRecord
+	nextSeq int
+}
+var historySize int
+var outputLines int
+
+// Segment output goes to logs/segment.log in the extraction directory
+const logsDir = "logs"
+const logName = "segment.log"
+
+var logSize int64
+var logFiles int
+var echoOutput bool
+
+// Resource limits for segments
+var limits sandbox.Limits
+var wallLimit time.Duration
+
+// Time segments get to leave after SIGTERM before /killsegment kills them
+var gracePeriod time.Duration
+
+// Time a killed segment gets to be gone before its slot is freed anyway
+const killWait = 5 * time.Second
+
+// Whether segments send their requests to other nodes through our proxy
+var useProxy bool
+
+// A worm that was shut down. Its segments from epoch (when the worm was
+// spread) or before are refused and stopped. Origin is set on the worm gate
+// that got the tombstone from the worm itself, which passes it on to the
+// other worm gates.
+type tombstone struct {
+	Epoch  int64     `json:"epoch"`
+	Time   time.Time `json:"time"`
+	Origin bool      `json:"origin,omitempty"`
+}
+
+// Tombstones by worm id. They are kept in tombstoneFile, so that they
+// outlive a restart, and forgotten after -maxrun, when no segment from
+// before the shutdown can be left.
+var tombstones = struct {
+	sync.Mutex
+	m map[string]tombstone
+}{m: make(map[string]tombstone)}
+var tombstoneFile string
+
+// How often the origin worm gate retries the worm gates it couldn't reach
+const tombstoneRetry = 2 * time.Second
+
+// segmentRecord is the life of one segment process.
+type segmentRecord struct {
+	Seq     int        `json:"seq"`
+	WormId  string     `json:"id"`
+	Port    string     `json:"sp"`
+	Pid     int        `json:"pid"`
+	Dir     string     `json:"dir"`
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+	// Seconds, so far if still running
+	Runtime float64 `json:"runtime"`
+	// running, killed (on /killsegment), timeout (ran past -walllimit),
+	// exited (status 0, usually a shutdown), crashed (nonzero status) or
+	// signaled (by someone else, or for going over -cpulimit)
+	Reason   string `json:"reason"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+	// Last lines of output, stdout and stderr mixed
+	Output []string `json:"output"`
+	Log    string   `json:"log"`
+
+	output        *tailWriter
+	killRequested bool
+	timedOut      bool
 }
 
+var (
+	segmentsLaunched = metrics.NewCounter("wormgate_segments_launched_total",
+		"Segments started.")
+	segmentsKilled = metrics.NewCounter("wormgate_segments_killed_total",
+		"Segments killed on request.")
+	segmentsTerminated = metrics.NewCounter("wormgate_segments_terminated_total",
+		"Segments that ended by themselves on SIGTERM within the grace period.")
+	segmentsExited = metrics.NewCounter("wormgate_segments_exited_total",
+		"Segment processes that ended, killed or not.")
+	payloadBytes = metrics.NewCounter("wormgate_payload_bytes_total",
+		"Bytes of segment payload received.")
+	extractionFailures = metrics.NewCounterVec("wormgate_extraction_failures_total",
+		"Segment payloads that could not be extracted.", "reason")
+	segmentsRefused = metrics.NewCounter("wormgate_segments_refused_total",
+		"Segments refused because their worm was shut down.")
+	_ = metrics.NewGaugeFunc("wormgate_disk_usage_bytes",
+		"Bytes used by extraction directories.", func() float64 {
+			used, _ := diskUsage()
+			return float64(used)
+		})
+	_ = metrics.NewGaugeFunc("wormgate_segments_running",
+		"Segment processes running.", func() float64 {
+			runningSegments.RLock()
+			defer runningSegments.RUnlock()
+			running := 0
+			for _, seg := range runningSegments.m {
+				if seg.p != nil {
+					running++
+				}
+			}
+			return float64(running)
+		})
+)
+
 func main() {
 
+	curuser, err := user.Current()
+	if err != nil {
+		log.Panic(err)
+	}
+
 	flag.StringVar(&wormgatePort, "wp", ":8181", "wormgate port (prefix with colon)")
 	flag.DurationVar(&maxRunTime, "maxrun", time.Minute*10, "max time to run (in case you forget shut down)")
+	var pubKeyFlag = flag.String("pubkey", "", "base64 ed25519 public key; only run segments signed with it")
+	var pubKeyFile = flag.String("pubkeyfile", "", "file with the public key, as written by segment keygen")
+	var secretFile = flag.String("secretfile", "", "shared secret for control requests, as written by the visualizer")
+	var partitionsFile = flag.String("partitions", "", "JSON file with more partition schemes")
+	flag.IntVar(&maxSegments, "maxsegments", 4, "max number of segments to run at once, one per worm")
+	flag.IntVar(&historySize, "history", 50, "number of ended segments to keep in /segments")
+	flag.IntVar(&outputLines, "outputlines", 20, "lines of segment output to keep in /segments")
+	flag.Int64Var(&logSize, "logsize", 1<<20, "size in bytes at which segment logs are rotated")
+	flag.IntVar(&logFiles, "logfiles", 3, "number of rotated segment logs to keep")
+	flag.BoolVar(&echoOutput, "echo", false, "also print segment output to our own stdout")
+	flag.DurationVar(&limits.CPU, "cpulimit", 0, "CPU time limit for segments (0 for none)")
+	var memLimit = flag.Uint64("memlimit", 0, "address space limit for segments in MiB (0 for none)")
+	flag.Uint64Var(&limits.Files, "filelimit", 0, "open file limit for segments (0 for none)")
+	flag.DurationVar(&wallLimit, "walllimit", 0, "wall-clock time limit for segments (0 for none)")
+	flag.DurationVar(&gracePeriod, "grace", 0, "time segments get to leave after SIGTERM before they are killed (0 to kill right away)")
+	flag.BoolVar(&limits.Namespaces, "namespaces", false, "run segments in new pid and mount namespaces if possible")
+	flag.BoolVar(&useProxy, "proxy", true, "make segments talk to other nodes through our proxy, which enforces the partition scheme")
+	flag.StringVar(&path, "path", "/tmp/wormgate-"+curuser.Username, "where to store segment code")
+	var maxPayloadMiB = flag.Int64("maxpayload", 64, "max size of a segment payload in MiB (0 for no limit)")
+	var quotaMiB = flag.Int64("quota", 1024, "max disk space for segments, logs included, in MiB (0 for no limit)")
+	var nodesSpec string
+	rocks.NodesFlag(flag.CommandLine, &nodesSpec)
 	flag.Parse()
+	limits.Memory = *memLimit << 20
+	maxPayload = *maxPayloadMiB << 20
+	quota = *quotaMiB << 20
 
-	allHosts = rocks.ListNodes()
+	err = rocks.Use(nodesSpec, wormgatePort)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	hostname, _ = os.Hostname()
-	log.SetPrefix(hostname + " wormgate: ")
+	if *pubKeyFlag != "" {
+		publicKey, err = payload.ParsePublicKey(*pubKeyFlag)
+	} else if *pubKeyFile != "" {
+		publicKey, err = payload.LoadPublicKey(*pubKeyFile)
+	}
+	if err != nil {
+		log.Panic("Could not load public key ", err)
+	}
+	if *secretFile != "" {
+		secret, err = auth.LoadSecret(*secretFile)
+		if err != nil {
+			log.Panic("Could not load secret ", err)
+		}
+	}
 
-	curuser, err := user.Current()
+	if *partitionsFile != "" {
+		partitions, err = partition.Load(*partitionsFile)
+		if err != nil {
+			log.Panic("Could not load partition schemes ", err)
+		}
+	}
+	partitionScheme.Store(partitions.Schemes()[0])
+
+	allHosts, err = rocks.ListNodes()
 	if err != nil {
-		log.Panic(err)
+		log.Panic("Error getting available nodes ", err)
 	}
-	log.Printf("Current user: %s\n", curuser.Username)
 
-	path = *flag.String("path", "/tmp/wormgate-"+curuser.Username,
-		"where to store segment code")
+	hostname = rocks.Hostname()
+	log.SetPrefix(hostname + " wormgate: ")
 
+	log.Printf("Current user: %s\n", curuser.Username)
+
+	err = os.MkdirAll(path, 0700)
+	if err != nil {
+		log.Panic("Could not create directory to store segments ", err)
+	}
 	log.Printf("Changing working directory to " + path)
 	os.Chdir(path)
 
-	rand.Seed(time.Now().Unix())
+	// Whatever an earlier run of this worm gate left behind is of no use
+	dirPrefix = strings.NewReplacer(":", "_", "/", "_").Replace(hostname+wormgatePort) + "-"
+	removeOldDirs()
 
-	flag.Parse()
+	// The worms that were shut down stay that way. Not named after
+	// dirPrefix, or it would go with the extraction directories.
+	tombstoneFile = filepath.Join(path, strings.TrimSuffix(dirPrefix, "-")+".tombstones")
+	loadTombstones()
+
+	rand.Seed(time.Now().Unix())
 
 	// Quit if maxRunTime timout
 	exitReason := make(chan string, 1)
@@ -66,22 +292,59 @@ func main() {
 		time.Sleep(maxRunTime)
 		exitReason <- fmt.Sprintf("maxrun timeout: %s", maxRunTime)
 	}()
+	// Segments run in their own process group, so they don't get our
+	// Ctrl-C. Take them down with us.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		reason := <-exitReason
-		log.Printf(reason)
+		select {
+		case sig := <-interrupt:
+			log.Printf("Got signal %s", sig)
+		case reason := <-exitReason:
+			log.Printf(reason)
+		}
 		log.Print("Shutting down")
+		runningSegments.Lock()
+		for _, seg := range runningSegments.m {
+			if seg.p != nil {
+				sandbox.Kill(seg.p.Pid)
+			}
+		}
 		os.Exit(0)
 	}()
 
+	verifier := auth.NewVerifier(secret, 30*time.Second)
+
 	http.HandleFunc("/", IndexHandler)
 	http.HandleFunc("/wormgate", WormGateHandler)
-	http.HandleFunc("/killsegment", killSegmentHandler)
-	http.HandleFunc("/partitionscheme", partitionSchemeHandler)
+	http.HandleFunc("/killsegment", verifier.Require(killSegmentHandler))
+	http.HandleFunc("/partitionscheme", verifier.Require(partitionSchemeHandler))
+	http.HandleFunc("/tombstone", verifier.Require(tombstoneHandler))
 	http.HandleFunc("/reachablehosts", reachableHostsHandler)
+	http.HandleFunc("/metrics", metrics.Handler)
+	http.HandleFunc("/segments", segmentsHandler)
+	http.HandleFunc("/logs", logsHandler)
+
+	// Proxy requests from segments come to the same port
+	segmentProxy := proxy.New(proxyTarget, isReachable)
+	segmentProxy.Profiles = linkProfiles
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if proxy.IsProxyRequest(r) {
+			if !proxyCaller(r, verifier) {
+				log.Printf("Refused proxy request for %s from %s", r.URL.Host, r.RemoteAddr)
+				io.Copy(ioutil.Discard, r.Body)
+				http.Error(w, "Proxy only serves segments on this node", http.StatusForbidden)
+				return
+			}
+			segmentProxy.ServeHTTP(w, r)
+			return
+		}
+		http.DefaultServeMux.ServeHTTP(w, r)
+	})
 
 	log.Printf("Started wormgate on %s%s\n", hostname, wormgatePort)
 
-	err = http.ListenAndServe(wormgatePort, nil)
+	err = http.ListenAndServe(rocks.ListenAddr(hostname, wormgatePort), handler)
 
 	if err != nil {
 		log.Panic(err)
@@ -91,11 +354,27 @@ func main() {
 func WormGateHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	runningSegment.Lock()
-	defer runningSegment.Unlock()
+	query := r.URL.Query()
+	var segmentPort = query.Get("sp")
+	wormId := query.Get("id")
+	if wormId == "" {
+		wormId = segmentPort
+	}
+	// Segments of worms from before epochs came along are epoch 0
+	epoch, _ := strconv.ParseInt(query.Get("epoch"), 10, 64)
+
+	if t, ok := buried(wormId, epoch); ok {
+		segmentsRefused.Inc()
+		log.Printf("Refused segment of worm %s, shut down at %s", wormId, t.Time.Format(time.RFC3339))
+		http.Error(w, fmt.Sprintf("Worm %s was shut down at %s", wormId, t.Time.Format(time.RFC3339)),
+			http.StatusGone)
+		io.Copy(ioutil.Discard, r.Body)
+		return
+	}
 
-	if runningSegment.p != nil {
-		http.Error(w, "Segment already running", 409)
+	seg, status, msg := reserveSegment(wormId, segmentPort)
+	if seg == nil {
+		http.Error(w, msg, status)
 
 		// Consume body
 		io.Copy(ioutil.Discard, r.Body)
@@ -103,120 +382,966 @@ func WormGateHandler(w http.ResponseWriter, r *http.Request) {
 
 		return
 	}
+	// Give the slot back unless the segment gets going
+	started := false
+	defer func() {
+		if !started {
+			releaseSegment(wormId, seg)
+		}
+	}()
 
-	var segmentPort = r.URL.Query().Get("sp")
-
-	log.Println("Received segment from", r.RemoteAddr)
+	log.Printf("Received segment of worm %s from %s", wormId, r.RemoteAddr)
 
-	// we'll extract and execute our segment in a new folder
-	randomstring := fmt.Sprintf("%x", rand.Int63())
-	extractionpath := path + "/" + randomstring
-	filename := "tmp.tar.gz"
-	fn := extractionpath + "/" + filename
+	if maxPayload > 0 && r.ContentLength > maxPayload {
+		extractionFailures.With("toolarge").Inc()
+		http.Error(w, fmt.Sprintf("Payload larger than %d bytes", maxPayload),
+			http.StatusRequestEntityTooLarge)
+		io.Copy(ioutil.Discard, r.Body)
+		return
+	}
+	if !makeRoom() {
+		extractionFailures.With("quota").Inc()
+		log.Printf("Refused segment, over the disk quota of %d bytes", quota)
+		http.Error(w, "Disk quota exceeded", http.StatusInsufficientStorage)
+		io.Copy(ioutil.Discard, r.Body)
+		return
+	}
 
-	// Create directory to store segment code.
-	err := os.MkdirAll(extractionpath, 0755)
+	// we'll extract and execute our segment in a new folder, with a
+	// random name that is unique even if other wormgates share the path
+	err := os.MkdirAll(path, 0700)
 	if err != nil {
 		log.Panic("Could not create directory to store segment ", err)
 	}
-	os.Chdir(extractionpath)
-	defer os.Chdir(path) // change back to base directory later
-
-	// Create file and store incoming segment
-	file, err := os.Create(fn)
+	extractionpath, err := ioutil.TempDir(path, dirPrefix)
 	if err != nil {
-		log.Panic("Could not create file to store segment", err)
+		log.Panic("Could not create directory to store segment ", err)
 	}
-	defer os.Remove(fn) // let's remove the tarball later
-
-	// Read from http POST
-	body, err := ioutil.ReadAll(r.Body)
+	// Extract segment straight from http POST
+	log.Printf("Extracting segment to %s", extractionpath)
+	var limited io.Reader = r.Body
+	if maxPayload > 0 {
+		limited = http.MaxBytesReader(w, r.Body, maxPayload)
+	}
+	body := metrics.CountingReader{R: limited, Counter: payloadBytes}
+	err = payload.Extract(body, extractionpath, publicKey, roomLeft())
 	if err != nil {
+		os.RemoveAll(extractionpath)
+		if payloadTooLarge(limited) {
+			extractionFailures.With("toolarge").Inc()
+			log.Printf("Refused segment from %s, payload larger than %d bytes", r.RemoteAddr, maxPayload)
+			http.Error(w, fmt.Sprintf("Payload larger than %d bytes", maxPayload),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		switch err := err.(type) {
+		case *payload.RejectError:
+			if err.OverBudget {
+				extractionFailures.With("quota").Inc()
+				log.Printf("Refused segment from %s, over the disk quota of %d bytes: %s", r.RemoteAddr, quota, err)
+				http.Error(w, "Disk quota exceeded: "+err.Error(), http.StatusInsufficientStorage)
+				return
+			}
+			extractionFailures.With("rejected").Inc()
+			log.Print("Rejected segment: ", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case *payload.VerifyError:
+			extractionFailures.With("unverified").Inc()
+			log.Printf("Refused segment from %s: %s", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		// Could not read body from POST.
 		// Probably the segment was killed while trying to send.
 		// That's the worm's problem, not ours. So just abort.
-		log.Print("Error reading payload.", err)
+		extractionFailures.With("read").Inc()
+		log.Print("Error extracting segment. ", err)
 		return
 	}
+	if !makeRoom() {
+		os.RemoveAll(extractionpath)
+		extractionFailures.With("quota").Inc()
+		log.Printf("Refused segment, over the disk quota of %d bytes", quota)
+		http.Error(w, "Disk quota exceeded", http.StatusInsufficientStorage)
+		return
+	}
+
+	// Start command, do not wait for it to complete
+	binary := extractionpath + "/" + payload.Binary
+	cmdline := []string{"stdbuf", "-oL", "-eL",
+			//binary, "run", "-wp", wormgatePort, "-sp", segmentPort}
+			binary, "run", "-wp", wormgatePort, "-sp", segmentPort, "-id", wormId,
+			"-maxrun", maxRunTime.String(), "-nodes", rocks.Spec()}
+	if useProxy {
+		cmdline = append(cmdline, "-proxy", rocks.LocalAddr(hostname, wormgatePort))
+	}
 
-	// Write tarball to file
-	_, err = file.Write(body)
+	log.Printf("Running segment: %q", cmdline)
+	cmd := exec.Command(cmdline[0], cmdline[1:]...)
+	logPath := filepath.Join(extractionpath, logsDir, logName)
+	segmentLog, err := openRotatingLog(logPath, logSize, logFiles)
+	if err != nil {
+		log.Print("Error creating segment log ", err)
+		return
+	}
+	var out io.Writer = segmentLog
+	if echoOutput {
+		out = io.MultiWriter(segmentLog, os.Stdout)
+	}
+	output := newTailWriter(out, outputLines)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if len(secret) > 0 {
+		cmd.Env = append(os.Environ(), auth.Env(secret))
+	}
+	// Not os.Chdir, other segments may be arriving at the same time
+	cmd.Dir = extractionpath
+	cmd, note, err := sandbox.Start(cmd, limits)
+	if note != "" {
+		log.Printf("Starting segment with %s", note)
+	}
 	if err != nil {
-		log.Print("Error writing payload file.", err)
+		if cmd.Process != nil {
+			// Started, but then killed for lack of limits
+			cmd.Wait()
+		}
+		segmentLog.Close()
+		os.RemoveAll(extractionpath)
+		log.Print("Error starting segment ", err)
+		http.Error(w, "Could not start segment", http.StatusInternalServerError)
 		return
 	}
+	rec := &segmentRecord{
+		WormId:  wormId,
+		Port:    segmentPort,
+		Pid:     cmd.Process.Pid,
+		Dir:     extractionpath,
+		Started: time.Now(),
+		Reason:  "running",
+		Log:     logPath,
+		output:  output,
+	}
+	addSegmentRecord(rec)
+	runningSegments.Lock()
+	seg.epoch = epoch
+	seg.p = cmd.Process
+	seg.rec = rec
+	seg.done = make(chan struct{})
+	runningSegments.Unlock()
+	started = true
+	segmentsLaunched.Inc()
+
+	// The worm may have been shut down while we were extracting. The
+	// tombstone handler stops the segments it finds running, and it
+	// didn't find this one.
+	if _, ok := buried(wormId, epoch); ok {
+		runningSegments.Lock()
+		segmentHistory.Lock()
+		rec.killRequested = true
+		segmentHistory.Unlock()
+		runningSegments.Unlock()
+		segmentsRefused.Inc()
+		log.Printf("Worm %s was shut down while its segment arrived", wormId)
+		go stopSegment(wormId, seg, gracePeriod)
+	}
+
+	var wallTimer *time.Timer
+	if wallLimit > 0 {
+		wallTimer = time.AfterFunc(wallLimit, func() {
+			runningSegments.Lock()
+			defer runningSegments.Unlock()
+			if runningSegments.m[wormId] != seg {
+				return
+			}
+			log.Printf("Segment process %d ran for %s, killing it", rec.Pid, wallLimit)
+			segmentHistory.Lock()
+			rec.timedOut = true
+			segmentHistory.Unlock()
+			sandbox.Kill(rec.Pid)
+		})
+	}
+
+	go func() {
+		// Wait for process to end, record why, and free the worm's slot
+		// unless a new segment took its place already
+		cmd.Wait()
+		if wallTimer != nil {
+			wallTimer.Stop()
+		}
+		segmentLog.Close()
+		cleanExtractionDir(extractionpath)
+		segmentsExited.Inc()
+
+		runningSegments.Lock()
+		endSegmentRecord(rec, cmd.ProcessState)
+		if runningSegments.m[wormId] == seg {
+			delete(runningSegments.m, wormId)
+		}
+		runningSegments.Unlock()
+		close(seg.done)
+		forgetEnded(historySize)
+		makeRoom()
+	}()
+}
+
+// reserveSegment takes a slot for a segment of a worm. If it can't, it
+// returns nil and the HTTP status and message to refuse the segment with.
+func reserveSegment(wormId, port string) (*runningSegment, int, string) {
+	if !wormIdPattern.MatchString(wormId) {
+		return nil, http.StatusBadRequest, fmt.Sprintf("Bad worm id %q", wormId)
+	}
+
+	runningSegments.Lock()
+	defer runningSegments.Unlock()
+	if _, ok := runningSegments.m[wormId]; ok {
+		return nil, http.StatusConflict, fmt.Sprintf("Segment of worm %s already running", wormId)
+	}
+	for other, seg := range runningSegments.m {
+		if seg.port == port {
+			return nil, http.StatusConflict,
+				fmt.Sprintf("Segment port %s already used by worm %s", port, other)
+		}
+	}
+	if len(runningSegments.m) >= maxSegments {
+		return nil, http.StatusServiceUnavailable,
+			fmt.Sprintf("Already running %d segments", len(runningSegments.m))
+	}
+	seg := &runningSegment{port: port}
+	runningSegments.m[wormId] = seg
+	return seg, 0, ""
+}
+
+func releaseSegment(wormId string, seg *runningSegment) {
+	runningSegments.Lock()
+	defer runningSegments.Unlock()
+	if runningSegments.m[wormId] == seg {
+		delete(runningSegments.m, wormId)
+	}
+}
 
-	err = file.Close()
+// cleanExtractionDir removes what a segment left behind, but keeps its logs
+func cleanExtractionDir(dir string) {
+	entries, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log.Print("Error closing payload file.", err)
+		log.Printf("Error cleaning up %s: %s", dir, err)
 		return
 	}
+	for _, entry := range entries {
+		if entry.Name() == logsDir {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("Error cleaning up %s: %s", dir, err)
+		}
+	}
+}
+
+func addSegmentRecord(rec *segmentRecord) {
+	segmentHistory.Lock()
+	segmentHistory.nextSeq++
+	rec.Seq = segmentHistory.nextSeq
+	segmentHistory.records = append(segmentHistory.records, rec)
+	segmentHistory.Unlock()
+
+	forgetEnded(historySize)
+}
+
+// forgetEnded drops the oldest ended segments from the history until keep
+// are left, and removes their extraction directories. It returns how many it
+// dropped.
+func forgetEnded(keep int) int {
+	segmentHistory.Lock()
+	ended := 0
+	for _, r := range segmentHistory.records {
+		if r.Ended != nil {
+			ended++
+		}
+	}
+	var forgotten []*segmentRecord
+	for i := 0; ended > keep && i < len(segmentHistory.records); {
+		if segmentHistory.records[i].Ended != nil {
+			forgotten = append(forgotten, segmentHistory.records[i])
+			segmentHistory.records = append(segmentHistory.records[:i],
+				segmentHistory.records[i+1:]...)
+			ended--
+		} else {
+			i++
+		}
+	}
+	segmentHistory.Unlock()
+
+	for _, rec := range forgotten {
+		if err := os.RemoveAll(rec.Dir); err != nil {
+			log.Printf("Error removing %s: %s", rec.Dir, err)
+		}
+	}
+	return len(forgotten)
+}
 
-	// extract segment
-	cmdline := []string{"tar", "-xzf", fn}
-	log.Printf("Extracting segment: %q", cmdline)
-	tarCmd := exec.Command(cmdline[0], cmdline[1:]...)
-	err = tarCmd.Run()
+// makeRoom forgets ended segments, oldest first, until the extraction
+// directories fit in the quota, with room to spare. It reports whether they
+// do.
+func makeRoom() bool {
+	if quota == 0 {
+		return true
+	}
+	for {
+		used, _ := diskUsage()
+		if used < quota {
+			return true
+		}
+		segmentHistory.Lock()
+		ended := 0
+		for _, r := range segmentHistory.records {
+			if r.Ended != nil {
+				ended++
+			}
+		}
+		segmentHistory.Unlock()
+		if ended == 0 || forgetEnded(ended-1) == 0 {
+			return false
+		}
+	}
+}
+
+// roomLeft returns how many bytes are left in the quota, 0 for no quota
+func roomLeft() int64 {
+	if quota == 0 {
+		return 0
+	}
+	used, _ := diskUsage()
+	if used >= quota {
+		// Used up by the logs since makeRoom. A budget of 0 would
+		// mean no limit, the smallest one refuses everything.
+		return 1
+	}
+	return quota - used
+}
+
+// diskUsage adds up the size of our extraction directories
+func diskUsage() (used int64, dirs int) {
+	matches, _ := filepath.Glob(filepath.Join(path, dirPrefix+"*"))
+	for _, dir := range matches {
+		dirs++
+		filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				used += info.Size()
+			}
+			return nil
+		})
+	}
+	return used, dirs
+}
+
+// removeOldDirs removes the extraction directories of an earlier run
+func removeOldDirs() {
+	matches, _ := filepath.Glob(filepath.Join(path, dirPrefix+"*"))
+	for _, dir := range matches {
+		log.Printf("Removing old extraction directory %s", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Error removing %s: %s", dir, err)
+		}
+	}
+}
+
+// payloadTooLarge tells whether reading a payload failed because it went over
+// -maxpayload
+func payloadTooLarge(body io.Reader) bool {
+	_, err := body.Read(nil)
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// endSegmentRecord records how a segment ended. Call with runningSegments
+// locked, so that killRequested is settled.
+func endSegmentRecord(rec *segmentRecord, state *os.ProcessState) {
+	segmentHistory.Lock()
+	defer segmentHistory.Unlock()
+
+	now := time.Now()
+	rec.Ended = &now
+	status, _ := state.Sys().(syscall.WaitStatus)
+	switch {
+	case status.Signaled():
+		rec.Signal = status.Signal().String()
+		rec.Reason = "signaled"
+		if rec.killRequested {
+			rec.Reason = "killed"
+		} else if rec.timedOut {
+			rec.Reason = "timeout"
+		}
+	case rec.killRequested:
+		code := state.ExitCode()
+		rec.ExitCode = &code
+		rec.Reason = "terminated"
+	case state.ExitCode() == 0:
+		code := 0
+		rec.ExitCode = &code
+		rec.Reason = "exited"
+	default:
+		code := state.ExitCode()
+		rec.ExitCode = &code
+		rec.Reason = "crashed"
+	}
+	log.Printf("Segment process %d %s after %s: %s", rec.Pid, rec.Reason,
+		now.Sub(rec.Started).Round(time.Millisecond), state)
+}
+
+// segmentsHandler lists the segments we ran, all or those of the worm with
+// the given id
+func segmentsHandler(w http.ResponseWriter, r *http.Request) {
+	// We don't use the body, but read it anyway
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+
+	wormId := r.URL.Query().Get("id")
+
+	segmentHistory.Lock()
+	now := time.Now()
+	records := []segmentRecord{}
+	for _, rec := range segmentHistory.records {
+		if wormId != "" && rec.WormId != wormId {
+			continue
+		}
+		copied := *rec
+		end := now
+		if rec.Ended != nil {
+			end = *rec.Ended
+		}
+		copied.Runtime = end.Sub(rec.Started).Seconds()
+		copied.Output = rec.output.Lines()
+		records = append(records, copied)
+	}
+	segmentHistory.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(records)
+}
+
+// logsHandler sends the log of a segment: the one with the given seq, the
+// latest of the worm with the given id, or the latest of all. With follow=1 it keeps sending what the segment writes until
+// it ends. With lines=N it starts with the last N lines.
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	// We don't use the body, but read it anyway
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
+
+	query := r.URL.Query()
+	seq, _ := strconv.Atoi(query.Get("seq"))
+	wormId := query.Get("id")
+	lines, _ := strconv.Atoi(query.Get("lines"))
+	follow := query.Get("follow") == "1"
+
+	var rec *segmentRecord
+	segmentHistory.Lock()
+	for _, candidate := range segmentHistory.records {
+		if seq != 0 && candidate.Seq != seq {
+			continue
+		}
+		if wormId != "" && candidate.WormId != wormId {
+			continue
+		}
+		rec = candidate
+	}
+	segmentHistory.Unlock()
+	if rec == nil {
+		http.Error(w, "No such segment", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(rec.Log)
 	if err != nil {
-		log.Print("Error extracting segment.", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	defer func() { file.Close() }()
 
-	// Start command, do not wait for it to complete
-	binary := extractionpath + "/" + "segment"
-	cmdline = []string{"stdbuf", "-oL", "-eL",
-			//binary, "run", "-wp", wormgatePort, "-sp", segmentPort}
-			binary, "run", "-wp", wormgatePort, "-sp", segmentPort, "-maxrun", maxRunTime.String()}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if lines > 0 {
+		skipToLastLines(file, lines)
+	}
+	if !follow {
+		io.Copy(w, file)
+		return
+	}
 
-	log.Printf("Running segment: %q", cmdline)
-	cmd := exec.Command(cmdline[0], cmdline[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	//cmd.Dir = path
-	err = cmd.Start()
+	flusher, _ := w.(http.Flusher)
+	for {
+		n, err := io.Copy(w, file)
+		if err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		segmentHistory.Lock()
+		ended := rec.Ended != nil
+		segmentHistory.Unlock()
+		if ended && n == 0 {
+			return
+		}
+
+		// Start over on the new file when the log was rotated
+		if current, err := os.Stat(rec.Log); err == nil {
+			if open, err := file.Stat(); err == nil && !os.SameFile(current, open) {
+				if reopened, err := os.Open(rec.Log); err == nil {
+					file.Close()
+					file = reopened
+					continue
+				}
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// skipToLastLines seeks file to the start of its last n lines
+func skipToLastLines(file *os.File, n int) {
+	data, err := ioutil.ReadAll(file)
 	if err != nil {
-		log.Print("Error starting segment ", err)
 		return
 	}
-	runningSegment.p = cmd.Process
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	start := end
+	for ; n > 0 && start > 0; n-- {
+		start = bytes.LastIndexByte(data[:start], '\n')
+		if start < 0 {
+			start = 0
+		}
+	}
+	if start > 0 {
+		start++ // after the newline
+	}
+	file.Seek(int64(start), io.SeekStart)
+}
 
-	go func() {
-		// Wait for process to end and reset the process pointer
-		runningSegment.RLock()
-		p := runningSegment.p
-		runningSegment.RUnlock()
+// rotatingLog is a log file that is renamed to .1 (and .1 to .2, and so on)
+// when it grows too big. Only the last keep old files are kept. Errors are
+// logged, not returned, so that the segment never blocks on its output.
+type rotatingLog struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	keep    int
+}
 
-		p.Wait()
+func openRotatingLog(path string, maxSize int64, keep int) (*rotatingLog, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingLog{path: path, file: file, maxSize: maxSize, keep: keep}, nil
+}
 
-		runningSegment.Lock()
-		runningSegment.p = nil
-		runningSegment.Unlock()
-	}()
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(p)) > l.maxSize && l.file != nil {
+		if err := l.rotate(); err != nil {
+			log.Printf("Error rotating %s, dropping segment output: %s", l.path, err)
+		}
+	}
+	if l.file == nil {
+		return len(p), nil
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing %s, dropping segment output: %s", l.path, err)
+		l.file.Close()
+		l.file = nil
+	}
+	return len(p), nil
+}
+
+func (l *rotatingLog) rotate() error {
+	l.file.Close()
+	if l.keep > 0 {
+		for i := l.keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		os.Rename(l.path, l.path+".1")
+	}
+	file, err := os.Create(l.path)
+	if err != nil {
+		l.file = nil
+		return err
+	}
+	l.file = file
+	l.size = 0
+	return nil
+}
+
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
 }
 
+// tailWriter passes output on, and keeps the last lines of it.
+type tailWriter struct {
+	out io.Writer
+
+	mu      sync.Mutex
+	lines   []string
+	max     int
+	partial []byte
+}
+
+func newTailWriter(out io.Writer, max int) *tailWriter {
+	return &tailWriter{out: out, max: max}
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.lines = append(t.lines, string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+	}
+	if len(t.lines) > t.max {
+		t.lines = append([]string(nil), t.lines[len(t.lines)-t.max:]...)
+	}
+	t.mu.Unlock()
+	return t.out.Write(p)
+}
+
+// Lines returns the last lines written, including an unfinished one.
+func (t *tailWriter) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := append([]string(nil), t.lines...)
+	if len(t.partial) > 0 {
+		lines = append(lines, string(t.partial))
+	}
+	return lines
+}
+
+// killSegmentHandler kills the segment of a worm. With a grace period
+// (-grace, or grace= in the query) the segment gets SIGTERM first, and is
+// only killed if it is still running when the grace period is over.
 func killSegmentHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	// We don't use the body, but read it anyway
 	io.Copy(ioutil.Discard, r.Body)
 
-	runningSegment.Lock()
-	if runningSegment.p != nil {
-		pid := runningSegment.p.Pid
-		log.Printf("Killing segment process %d", pid)
-		err := runningSegment.p.Kill()
-		if err != nil {
-			log.Panicf("Could not kill segment process %d: %s",
-				pid, err)
+	query := r.URL.Query()
+	grace := gracePeriod
+	if value := query.Get("grace"); value != "" {
+		var err error
+		grace, err = time.ParseDuration(value)
+		if err != nil || grace < 0 {
+			http.Error(w, fmt.Sprintf("Bad grace period %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	runningSegments.Lock()
+	// Without an id there must be no doubt about which segment to kill
+	wormId := query.Get("id")
+	if wormId == "" {
+		if len(runningSegments.m) > 1 {
+			runningSegments.Unlock()
+			http.Error(w, fmt.Sprintf("Running %d segments, say which with id=",
+				len(runningSegments.m)), http.StatusBadRequest)
+			return
+		}
+		for id := range runningSegments.m {
+			wormId = id
 		}
-		runningSegment.p = nil
-		fmt.Fprintf(w, "Killed segment process %d\n", pid)
-	} else {
+	}
+	seg := runningSegments.m[wormId]
+	if seg == nil || seg.p == nil {
+		runningSegments.Unlock()
 		msg := "No segment process to kill\n"
 		log.Printf(msg)
 		fmt.Fprintf(w, msg)
+		return
+	}
+	segmentHistory.Lock()
+	seg.rec.killRequested = true
+	segmentHistory.Unlock()
+	runningSegments.Unlock()
+
+	msg, err := stopSegment(wormId, seg, grace)
+	if err != nil {
+		log.Printf("Error stopping segment: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	runningSegment.Unlock()
+	fmt.Fprint(w, msg)
+}
+
+// stopSegment ends a segment process, gracefully if grace is not zero, and
+// says how it went
+func stopSegment(wormId string, seg *runningSegment, grace time.Duration) (string, error) {
+	pid := seg.p.Pid
+	if grace > 0 {
+		log.Printf("Asking segment process %d of worm %s to leave", pid, wormId)
+		start := time.Now()
+		err := sandbox.Signal(pid, int(syscall.SIGTERM))
+		if err != nil {
+			log.Printf("Could not signal segment process %d: %s", pid, err)
+		} else {
+			select {
+			case <-seg.done:
+				segmentsTerminated.Inc()
+				return fmt.Sprintf("Segment process %d left after SIGTERM in %s\n",
+					pid, time.Since(start).Round(time.Millisecond)), nil
+			case <-time.After(grace):
+				log.Printf("Segment process %d still running after %s", pid, grace)
+			}
+		}
+	}
+
+	log.Printf("Killing segment process %d of worm %s", pid, wormId)
+	err := sandbox.Kill(pid)
+	if err != nil {
+		select {
+		case <-seg.done:
+			return fmt.Sprintf("Segment process %d ended by itself\n", pid), nil
+		default:
+		}
+		return "", fmt.Errorf("could not kill segment process %d: %s", pid, err)
+	}
+	// The slot is freed when the process is gone, so that the next segment
+	// doesn't find the port still taken
+	select {
+	case <-seg.done:
+	case <-time.After(killWait):
+		log.Printf("Segment process %d still there %s after it was killed", pid, killWait)
+		releaseSegment(wormId, seg)
+	}
+	segmentsKilled.Inc()
+	if grace > 0 {
+		return fmt.Sprintf("Killed segment process %d after %s grace period\n", pid, grace), nil
+	}
+	return fmt.Sprintf("Killed segment process %d\n", pid), nil
+}
+
+// tombstoneHandler shuts a worm down for good (POST ?id=worm&epoch=N): the
+// segment of it we run is stopped, and segments of it from epoch N or before
+// are refused from now on. Unless relayed=1 is given, we pass the tombstone on
+// to the other worm gates. GET lists the tombstones.
+func tombstoneHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// We don't use the body, but read it anyway
+	io.Copy(ioutil.Discard, r.Body)
+
+	if r.Method == "GET" {
+		tombstones.Lock()
+		defer tombstones.Unlock()
+		for wormId, t := range tombstones.m {
+			fmt.Fprintf(w, "%s %d %s\n", wormId, t.Epoch, t.Time.Format(time.RFC3339))
+		}
+		return
+	}
+
+	query := r.URL.Query()
+	wormId := query.Get("id")
+	if !wormIdPattern.MatchString(wormId) {
+		http.Error(w, fmt.Sprintf("Bad worm id %q", wormId), http.StatusBadRequest)
+		return
+	}
+	epoch, err := strconv.ParseInt(query.Get("epoch"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad epoch %q", query.Get("epoch")), http.StatusBadRequest)
+		return
+	}
+
+	t, isNew := bury(wormId, epoch, query.Get("relayed") == "")
+	if isNew {
+		log.Printf("Worm %s was shut down, refusing its segments up to epoch %d", wormId, epoch)
+		if t.Origin {
+			go spreadTombstone(wormId, t)
+		}
+	}
+
+	runningSegments.Lock()
+	seg := runningSegments.m[wormId]
+	if seg == nil || seg.p == nil || seg.epoch > epoch {
+		runningSegments.Unlock()
+		fmt.Fprint(w, "No segment running\n")
+		return
+	}
+	segmentHistory.Lock()
+	seg.rec.killRequested = true
+	segmentHistory.Unlock()
+	runningSegments.Unlock()
+
+	msg, err := stopSegment(wormId, seg, gracePeriod)
+	if err != nil {
+		log.Printf("Error stopping segment: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, msg)
+}
+
+// buried returns the tombstone of a worm, if its segments from epoch are to
+// be refused
+func buried(wormId string, epoch int64) (tombstone, bool) {
+	tombstones.Lock()
+	defer tombstones.Unlock()
+	t, ok := tombstones.m[wormId]
+	if !ok || epoch > t.Epoch || time.Since(t.Time) > maxRunTime {
+		return tombstone{}, false
+	}
+	return t, true
+}
+
+// bury stores a tombstone, unless we have one for the same epoch or a later
+// one already. It reports whether the tombstone is new.
+func bury(wormId string, epoch int64, origin bool) (tombstone, bool) {
+	tombstones.Lock()
+	defer tombstones.Unlock()
+
+	if t, ok := tombstones.m[wormId]; ok && t.Epoch >= epoch && time.Since(t.Time) <= maxRunTime {
+		return t, false
+	}
+	t := tombstone{Epoch: epoch, Time: time.Now(), Origin: origin}
+	tombstones.m[wormId] = t
+	for id, old := range tombstones.m {
+		if time.Since(old.Time) > maxRunTime {
+			delete(tombstones.m, id)
+		}
+	}
+	saveTombstones()
+	return t, true
+}
+
+// saveTombstones writes the tombstones to tombstoneFile. Call with
+// tombstones locked.
+func saveTombstones() {
+	data, err := json.Marshal(tombstones.m)
+	if err != nil {
+		log.Printf("Error saving tombstones: %s", err)
+		return
+	}
+	tmp := tombstoneFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Error saving tombstones: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, tombstoneFile); err != nil {
+		log.Printf("Error saving tombstones: %s", err)
+	}
+}
+
+// loadTombstones picks up the tombstones of an earlier run, and goes on
+// passing on the ones we got from the worm itself
+func loadTombstones() {
+	data, err := ioutil.ReadFile(tombstoneFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error loading tombstones: %s", err)
+		}
+		return
+	}
+	tombstones.Lock()
+	defer tombstones.Unlock()
+	if err := json.Unmarshal(data, &tombstones.m); err != nil {
+		log.Printf("Error loading tombstones from %s: %s", tombstoneFile, err)
+		return
+	}
+	for wormId, t := range tombstones.m {
+		if time.Since(t.Time) > maxRunTime {
+			delete(tombstones.m, wormId)
+			continue
+		}
+		log.Printf("Worm %s was shut down at %s", wormId, t.Time.Format(time.RFC3339))
+		if t.Origin {
+			go spreadTombstone(wormId, t)
+		}
+	}
+}
+
+// spreadTombstone passes a tombstone on to the other worm gates, and keeps
+// trying the ones it can't reach, until they all have it or it expires
+func spreadTombstone(wormId string, t tombstone) {
+	client := &http.Client{
+		Transport: &auth.Transport{Secret: secret, Base: &http.Transport{}},
+		Timeout:   gracePeriod + 10*time.Second,
+	}
+	var pending []string
+	for _, node := range allHosts {
+		if node != hostname && node != strings.TrimSuffix(hostname, ".local") {
+			pending = append(pending, node)
+		}
+	}
+
+	for len(pending) > 0 && time.Since(t.Time) < maxRunTime {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var left []string
+		for _, node := range pending {
+			if !isReachable(node) {
+				left = append(left, node)
+				continue
+			}
+			wg.Add(1)
+			go func(node string) {
+				defer wg.Done()
+				if err := postTombstone(client, node, wormId, t.Epoch); err != nil {
+					mu.Lock()
+					left = append(left, node)
+					mu.Unlock()
+				}
+			}(node)
+		}
+		wg.Wait()
+		if len(left) < len(pending) {
+			log.Printf("Passed on tombstone of worm %s, %d worm gates left", wormId, len(left))
+		}
+		pending = left
+		if len(pending) > 0 {
+			time.Sleep(tombstoneRetry)
+		}
+	}
+}
+
+func postTombstone(client *http.Client, node, wormId string, epoch int64) error {
+	url := fmt.Sprintf("http://%s/tombstone?id=%s&epoch=%d&relayed=1",
+		rocks.Addr(node, wormgatePort), wormId, epoch)
+	resp, err := client.Post(url, "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tombstone for %s: %s", node, resp.Status)
+	}
+	return nil
 }
 
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
@@ -227,6 +1352,37 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 
 	body := "Wormgate running on " + hostname
 	fmt.Fprintf(w, "<h1>%s</h1></br><p>Post segments to to /segment</p>", body)
+
+	used, dirs := diskUsage()
+	limit := "no quota"
+	if quota > 0 {
+		limit = fmt.Sprintf("%.1f%% of %s quota", 100*float64(used)/float64(quota), mib(quota))
+	}
+	fmt.Fprintf(w, "<p>Disk: %s in %d directories under %s (%s)</p>",
+		mib(used), dirs, html.EscapeString(path), limit)
+}
+
+func mib(bytes int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(bytes)/(1<<20))
+}
+
+// The reachable hosts change whenever the partition scheme does. Watchers
+// wait on changed, which is closed and replaced on every change.
+var reachability = struct {
+	sync.Mutex
+	version uint64
+	changed chan struct{}
+}{version: 1, changed: make(chan struct{})}
+
+// How long a watch waits for a change before answering anyway
+const watchTimeout = 25 * time.Second
+
+func reachabilityChanged() {
+	reachability.Lock()
+	defer reachability.Unlock()
+	reachability.version++
+	close(reachability.changed)
+	reachability.changed = make(chan struct{})
 }
 
 func reachableHostsHandler(w http.ResponseWriter, r *http.Request) {
@@ -234,44 +1390,120 @@ func reachableHostsHandler(w http.ResponseWriter, r *http.Request) {
 	io.Copy(ioutil.Discard, r.Body)
 	r.Body.Close()
 
+	query := r.URL.Query()
+	reachability.Lock()
+	version, changed := reachability.version, reachability.changed
+	reachability.Unlock()
+
+	if query.Get("watch") != "" && query.Get("version") == fmt.Sprint(version) {
+		select {
+		case <-changed:
+		case <-time.After(watchTimeout):
+		case <-r.Context().Done():
+			return
+		}
+		reachability.Lock()
+		version = reachability.version
+		reachability.Unlock()
+	}
+
+	// The version is read before the hosts, so a change in between is
+	// seen again by the next watch
+	w.Header().Set("X-Worm-Reachable-Version", fmt.Sprint(version))
 	for _,host := range reachableHosts() {
 		fmt.Fprintln(w, host)
 	}
 }
 
 func reachableHosts() []string {
-	var reachable []string
+	ps := partitionScheme.Load().(*partition.Scheme)
+	return ps.Reachable(hostname, allHosts)
+}
 
-	ps := atomic.LoadInt32(&partitionScheme)
-	if ps==0 {
-		for _,host := range allHosts {
-			reachable = append(reachable, host)
+func isReachable(node string) bool {
+	for _, host := range reachableHosts() {
+		if host == node {
+			return true
 		}
 	}
-	if ps==1 {
-		for _,host := range allHosts {
-			n := len("compute-x")
-			if host[0:n] == hostname[0:n] {
-				reachable = append(reachable, host)
+	return false
+}
+
+// linkProfiles says how the links to node and back behave under the current
+// partition scheme
+func linkProfiles(node string) (out, back partition.Profile) {
+	ps := partitionScheme.Load().(*partition.Scheme)
+	return ps.Profile(hostname, node), ps.Profile(node, hostname)
+}
+
+// proxyCaller reports whether a proxy request may be served: it comes from
+// this node, where our segments run, or is signed with the secret.
+func proxyCaller(r *http.Request, verifier *auth.Verifier) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+		return true
+	}
+	return len(secret) > 0 && verifier.Verify(r) == nil
+}
+
+// proxyTarget finds the node a proxy request from a segment is for, and its
+// address. Segments name nodes as they are named in the reachable hosts, or
+// give the address of the node, as they must when the node name has a port
+// of its own. They may only reach worm gates and the segments of the worms we
+// run.
+func proxyTarget(hostport string) (string, string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", "", err
+	}
+	host = strings.TrimSuffix(host, ".local")
+	hostport = net.JoinHostPort(host, port)
+	ports := proxyPorts()
+	for _, node := range allHosts {
+		for _, p := range ports {
+			addr := rocks.Addr(node, p)
+			if (node == host && p == ":"+port) || addr == hostport {
+				return node, addr, nil
 			}
 		}
 	}
-	return reachable
+	return "", "", fmt.Errorf("%s is not a worm gate or segment on a worm node", hostport)
+}
+
+// proxyPorts returns the ports segments may reach on other nodes: the worm
+// gate port, and the ports of the segments we run
+func proxyPorts() []string {
+	ports := []string{wormgatePort}
+	runningSegments.RLock()
+	defer runningSegments.RUnlock()
+	for _, seg := range runningSegments.m {
+		ports = append(ports, seg.port)
+	}
+	return ports
 }
 
 func partitionSchemeHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		log.Printf("Error reading partitionScheme: %s", err)
+		return
+	}
 
-	var ps int32
-	pc, rateErr := fmt.Fscanf(r.Body, "%d", &ps)
-	if pc != 1 || rateErr != nil {
-		log.Printf("Error parsing partitionScheme (%d items): %s", pc, rateErr)
+	if r.Method == "GET" {
+		fmt.Fprintln(w, partitionScheme.Load())
+		return
 	}
 
-	// Consume and close rest of body
-	io.Copy(ioutil.Discard, r.Body)
-	r.Body.Close()
+	ps, err := partitions.Lookup(string(body))
+	if err != nil {
+		log.Printf("Error parsing partitionScheme: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	log.Printf("New partitionScheme: %d", ps)
-	atomic.StoreInt32(&partitionScheme, ps)
+	log.Printf("New partitionScheme: %s", ps)
+	partitionScheme.Store(ps)
+	reachabilityChanged()
 	log.Printf("Reachable hosts: %s", strings.Join(reachableHosts()," "))
 }